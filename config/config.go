@@ -0,0 +1,281 @@
+// Package config reads the YAML config file. Its keys are the names of the
+// command line flags, a flag or its env var takes precedence over the file,
+// which takes precedence over the flag default.
+//
+//	metadata-address:
+//	- 169.254.169.250
+//	- 10.0.0.2
+//	poll-interval: 10s
+//	nat-ipset-name: RANCHER_DISABLE_HOST_NAT_IPSET
+//	nat-exempt-cidr:
+//	- 192.168.0.0/16
+//	route-update-option:
+//	  routefile.path: /run/per-host-subnet/routes
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v2"
+)
+
+// fileOnlyFlags are the flags the config file can't set.
+var fileOnlyFlags = map[string]bool{
+	"config":             true,
+	"help":               true,
+	"version":            true,
+	"register-service":   true,
+	"unregister-service": true,
+}
+
+type Config struct {
+	ctx   *cli.Context
+	path  string
+	flags map[string]cli.Flag
+	file  map[string]interface{}
+}
+
+// Load reads and validates the config file at path, an empty path only uses
+// the flags.
+func Load(ctx *cli.Context, path string) (*Config, error) {
+	c := &Config{
+		ctx:   ctx,
+		path:  path,
+		flags: map[string]cli.Flag{},
+		file:  map[string]interface{}{},
+	}
+	for _, f := range ctx.App.Flags {
+		c.flags[flagName(f)] = f
+	}
+	if path == "" {
+		return c, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read config file")
+	}
+	raw := map[string]interface{}{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse config file %s", path)
+	}
+	for key, v := range raw {
+		f, ok := c.flags[key]
+		if !ok || fileOnlyFlags[key] {
+			return nil, errors.Errorf("Invalid config file %s: unknown setting %s", path, key)
+		}
+		value, err := convert(f, v)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Invalid config file %s: setting %s", path, key)
+		}
+		c.file[key] = value
+	}
+	return c, nil
+}
+
+// Reload reads the config file again.
+func (c *Config) Reload() (*Config, error) {
+	return Load(c.ctx, c.path)
+}
+
+// Path returns the config file path, empty when there's none.
+func (c *Config) Path() string {
+	return c.path
+}
+
+func (c *Config) String(name string) string {
+	if v, ok := c.fromFile(name); ok {
+		return v.(string)
+	}
+	return c.ctx.String(name)
+}
+
+func (c *Config) StringSlice(name string) []string {
+	if v, ok := c.fromFile(name); ok {
+		return v.([]string)
+	}
+	return c.ctx.StringSlice(name)
+}
+
+func (c *Config) Bool(name string) bool {
+	if v, ok := c.fromFile(name); ok {
+		return v.(bool)
+	}
+	return c.ctx.Bool(name)
+}
+
+func (c *Config) Int(name string) int {
+	if v, ok := c.fromFile(name); ok {
+		return v.(int)
+	}
+	return c.ctx.Int(name)
+}
+
+func (c *Config) Float64(name string) float64 {
+	if v, ok := c.fromFile(name); ok {
+		return v.(float64)
+	}
+	return c.ctx.Float64(name)
+}
+
+func (c *Config) Duration(name string) time.Duration {
+	if v, ok := c.fromFile(name); ok {
+		return v.(time.Duration)
+	}
+	return c.ctx.Duration(name)
+}
+
+// Changed lists the settings whose value differs in o.
+func (c *Config) Changed(o *Config) []string {
+	var rtn []string
+	for name := range c.flags {
+		if fmt.Sprint(c.value(name)) != fmt.Sprint(o.value(name)) {
+			rtn = append(rtn, name)
+		}
+	}
+	sort.Strings(rtn)
+	return rtn
+}
+
+func (c *Config) value(name string) interface{} {
+	switch c.flags[name].(type) {
+	case cli.StringFlag:
+		return c.String(name)
+	case cli.StringSliceFlag:
+		return c.StringSlice(name)
+	case cli.BoolFlag:
+		return c.Bool(name)
+	case cli.IntFlag:
+		return c.Int(name)
+	case cli.Float64Flag:
+		return c.Float64(name)
+	case cli.DurationFlag:
+		return c.Duration(name)
+	}
+	return nil
+}
+
+// fromFile returns the file value of name, unless the flag or its env var is
+// set.
+func (c *Config) fromFile(name string) (interface{}, bool) {
+	v, ok := c.file[name]
+	if !ok || c.ctx.IsSet(name) || envSet(c.flags[name]) {
+		return nil, false
+	}
+	return v, true
+}
+
+func flagName(f cli.Flag) string {
+	return strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+}
+
+// envSet tells if the env var of f is set, the cli package applies env vars
+// as defaults so IsSet doesn't report them.
+func envSet(f cli.Flag) bool {
+	var envVar string
+	switch f := f.(type) {
+	case cli.StringFlag:
+		envVar = f.EnvVar
+	case cli.StringSliceFlag:
+		envVar = f.EnvVar
+	case cli.BoolFlag:
+		envVar = f.EnvVar
+	case cli.IntFlag:
+		envVar = f.EnvVar
+	case cli.Float64Flag:
+		envVar = f.EnvVar
+	case cli.DurationFlag:
+		envVar = f.EnvVar
+	}
+	if envVar == "" {
+		return false
+	}
+	for _, e := range strings.Split(envVar, ",") {
+		if os.Getenv(strings.TrimSpace(e)) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// convert checks a file value against the type of its flag.
+func convert(f cli.Flag, v interface{}) (interface{}, error) {
+	switch f.(type) {
+	case cli.StringFlag:
+		return scalar(v)
+	case cli.StringSliceFlag:
+		return stringSlice(v)
+	case cli.BoolFlag:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+		return nil, errors.Errorf("expected a boolean, got %v", v)
+	case cli.IntFlag:
+		if i, ok := v.(int); ok {
+			return i, nil
+		}
+		return nil, errors.Errorf("expected an integer, got %v", v)
+	case cli.Float64Flag:
+		switch n := v.(type) {
+		case float64:
+			return n, nil
+		case int:
+			return float64(n), nil
+		}
+		return nil, errors.Errorf("expected a number, got %v", v)
+	case cli.DurationFlag:
+		s, ok := v.(string)
+		if !ok {
+			return nil, errors.Errorf("expected a duration like 30s, got %v", v)
+		}
+		return time.ParseDuration(s)
+	}
+	return nil, errors.New("not supported in the config file")
+}
+
+func scalar(v interface{}) (string, error) {
+	switch v.(type) {
+	case string, int, float64, bool:
+		return fmt.Sprint(v), nil
+	}
+	return "", errors.Errorf("expected a single value, got %v", v)
+}
+
+// stringSlice accepts a list, a single value, or a map turned into sorted
+// key=value items.
+func stringSlice(v interface{}) ([]string, error) {
+	var rtn []string
+	switch v := v.(type) {
+	case []interface{}:
+		for _, item := range v {
+			s, err := scalar(item)
+			if err != nil {
+				return nil, err
+			}
+			rtn = append(rtn, s)
+		}
+	case map[interface{}]interface{}:
+		for k, item := range v {
+			s, err := scalar(item)
+			if err != nil {
+				return nil, err
+			}
+			rtn = append(rtn, fmt.Sprintf("%v=%s", k, s))
+		}
+		sort.Strings(rtn)
+	default:
+		s, err := scalar(v)
+		if err != nil {
+			return nil, err
+		}
+		rtn = append(rtn, s)
+	}
+	return rtn, nil
+}
@@ -0,0 +1,17 @@
+// Package conntrack deletes IPv4 connection tracking entries over the
+// ctnetlink protocol, so established connections go through NAT again.
+package conntrack
+
+import (
+	"net"
+)
+
+// Delete deletes the entries whose original source is within one of srcs
+// and original destination within one of dsts, and returns how many were
+// deleted. Entries vanishing meanwhile are not an error.
+func Delete(srcs, dsts []*net.IPNet) (int, error) {
+	if len(srcs) == 0 || len(dsts) == 0 {
+		return 0, nil
+	}
+	return deleteEntries(srcs, dsts)
+}
@@ -0,0 +1,146 @@
+package conntrack
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/per-host-subnet/internal/nfnetlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+)
+
+// From linux/netfilter/nfnetlink.h and linux/netfilter/nfnetlink_conntrack.h.
+const (
+	nfnlSubsysCTNetlink = 1
+
+	cmdGet    = 1
+	cmdDelete = 2
+
+	attrTupleOrig = 1
+	attrID        = 12
+	attrZone      = 18
+
+	attrTupleIP = 1
+	attrIPv4Src = 1
+	attrIPv4Dst = 2
+)
+
+// entry holds the attributes identifying a conntrack entry, as dumped.
+type entry struct {
+	tuple []byte
+	id    []byte
+	zone  []byte
+}
+
+// deleteEntries dumps the table and deletes the matching entries, over a
+// single socket. The ID makes sure a reused tuple isn't deleted.
+func deleteEntries(srcs, dsts []*net.IPNet) (int, error) {
+	s, err := nl.GetNetlinkSocketAt(netns.None(), netns.None(), syscall.NETLINK_NETFILTER)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to open netlink socket")
+	}
+	defer s.Close()
+	sockets := map[int]*nl.SocketHandle{
+		syscall.NETLINK_NETFILTER: {Socket: s},
+	}
+
+	req := nfnetlink.NewRequest(nfnlSubsysCTNetlink, cmdGet, nfnetlink.NlmFDump, syscall.AF_INET)
+	req.Sockets = sockets
+	msgs, err := req.Execute(syscall.NETLINK_NETFILTER, 0)
+	if err != nil {
+		return 0, errors.Wrap(err, "Failed to list conntrack entries")
+	}
+
+	deleted := 0
+	for _, m := range msgs {
+		e, src, dst, err := parseEntry(m)
+		if err != nil {
+			return deleted, errors.Wrap(err, "Failed to parse conntrack entry")
+		}
+		if src == nil || dst == nil || !contains(srcs, src) || !contains(dsts, dst) {
+			continue
+		}
+		req := nfnetlink.NewRequest(nfnlSubsysCTNetlink, cmdDelete, syscall.NLM_F_ACK, syscall.AF_INET)
+		req.Sockets = sockets
+		req.AddData(nl.NewRtAttr(attrTupleOrig|nfnetlink.NlaFNested, e.tuple))
+		if e.zone != nil {
+			req.AddData(nl.NewRtAttr(attrZone|nfnetlink.NlaFNetByteorder, e.zone))
+		}
+		if e.id != nil {
+			req.AddData(nl.NewRtAttr(attrID|nfnetlink.NlaFNetByteorder, e.id))
+		}
+		_, err = req.Execute(syscall.NETLINK_NETFILTER, 0)
+		if err == syscall.ENOENT {
+			continue
+		}
+		if err != nil {
+			return deleted, errors.Wrapf(err, "Failed to delete conntrack entry from %s to %s", src, dst)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// parseEntry returns the identifying attributes of a dumped entry and its
+// original source and destination, nil if it has none.
+func parseEntry(m []byte) (entry, net.IP, net.IP, error) {
+	var e entry
+	attrs, err := nfnetlink.ParseAttrs(m)
+	if err != nil {
+		return e, nil, nil, err
+	}
+	for _, a := range attrs {
+		switch nfnetlink.AttrType(a) {
+		case attrTupleOrig:
+			e.tuple = a.Value
+		case attrID:
+			e.id = a.Value
+		case attrZone:
+			e.zone = a.Value
+		}
+	}
+	if e.tuple == nil {
+		return e, nil, nil, nil
+	}
+	src, dst, err := tupleAddrs(e.tuple)
+	return e, src, dst, err
+}
+
+// tupleAddrs reads the IPv4 source and destination of a CTA_TUPLE_ORIG.
+func tupleAddrs(b []byte) (src, dst net.IP, err error) {
+	tuple, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, t := range tuple {
+		if nfnetlink.AttrType(t) != attrTupleIP {
+			continue
+		}
+		ips, err := nl.ParseRouteAttr(t.Value)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, ip := range ips {
+			if len(ip.Value) != net.IPv4len {
+				continue
+			}
+			switch nfnetlink.AttrType(ip) {
+			case attrIPv4Src:
+				src = net.IP(ip.Value)
+			case attrIPv4Dst:
+				dst = net.IP(ip.Value)
+			}
+		}
+	}
+	return src, dst, nil
+}
+
+func contains(subnets []*net.IPNet, ip net.IP) bool {
+	for _, s := range subnets {
+		if s.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,13 @@
+//+build !linux
+
+package conntrack
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+func deleteEntries(srcs, dsts []*net.IPNet) (int, error) {
+	return 0, errors.New("conntrack is only supported on linux")
+}
@@ -0,0 +1,67 @@
+// Package egress sends the outbound traffic of the labelled containers out of
+// the cluster through a single gateway host. The other hosts route it to the
+// gateway agent IP, the gateway SNATs it, see hostnat.
+package egress
+
+import (
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/per-host-subnet/reconcile"
+	"github.com/rancher/per-host-subnet/setting"
+)
+
+// Gateway returns the host whose gateway label holds the address egress
+// traffic is SNATed to, along with that address. With several of them, the
+// first by name wins so every host picks the same one.
+func Gateway(s *reconcile.Snapshot) (metadata.Host, net.IP, bool) {
+	var gateways []metadata.Host
+	for _, h := range s.Hosts {
+		v, ok := h.Labels[setting.EgressGatewayLabel]
+		if !ok || v == "" {
+			continue
+		}
+		if net.ParseIP(v).To4() == nil {
+			logrus.Warnf("Invalid host %s label %s %q, skipping it as egress gateway", h.Name, setting.EgressGatewayLabel, v)
+			continue
+		}
+		gateways = append(gateways, h)
+	}
+	if len(gateways) == 0 {
+		return metadata.Host{}, nil, false
+	}
+	sort.Slice(gateways, func(i, j int) bool {
+		return gateways[i].Name < gateways[j].Name
+	})
+	if len(gateways) > 1 {
+		logrus.Warnf("Several egress gateways, using host %s", gateways[0].Name)
+	}
+	return gateways[0], net.ParseIP(gateways[0].Labels[setting.EgressGatewayLabel]).To4(), true
+}
+
+// Sources returns the addresses, as /32 subnets, of the running egress
+// containers of the host hostUUID, or of every host when empty.
+func Sources(s *reconcile.Snapshot, hostUUID string) map[string]bool {
+	sources := map[string]bool{}
+	for _, c := range s.Containers {
+		if hostUUID != "" && c.HostUUID != hostUUID {
+			continue
+		}
+		if !(c.State == "running" || c.State == "starting" || c.State == "stopping") {
+			continue
+		}
+		if b, _ := strconv.ParseBool(c.Labels[setting.EgressLabel]); !b {
+			continue
+		}
+		ip := net.ParseIP(c.PrimaryIp).To4()
+		if ip == nil {
+			logrus.Warnf("Invalid container %s primary IP %q, skipping its egress label", c.Name, c.PrimaryIp)
+			continue
+		}
+		sources[(&net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}).String()] = true
+	}
+	return sources
+}
@@ -0,0 +1,326 @@
+package egress
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/per-host-subnet/reconcile"
+	"github.com/rancher/per-host-subnet/routeupdate"
+	"github.com/rancher/per-host-subnet/setting"
+	"github.com/rancher/per-host-subnet/state"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+const (
+	ruleKind  = "rule"
+	routeKind = "route"
+
+	// linkLocal keeps the metadata address off the gateway.
+	linkLocal = "169.254.0.0/16"
+)
+
+// Watch routes the traffic of the local egress containers through the
+// routing table table, looked up by rules of priority priority. The rules of
+// that priority looking up table are the agent's, while in table only the
+// routes it recorded are ever removed. Nothing is looked at until egress is
+// in use.
+func Watch(r *reconcile.Reconciler, table, priority int) error {
+	if table <= 0 || table == syscall.RT_TABLE_MAIN || table == syscall.RT_TABLE_LOCAL || table == syscall.RT_TABLE_DEFAULT {
+		return errors.Errorf("Invalid egress routing table %d", table)
+	}
+	if priority <= 0 {
+		return errors.Errorf("Invalid egress rule priority %d", priority)
+	}
+	w := &watcher{
+		table:    table,
+		priority: priority,
+		retries:  r.NewRetryQueue(),
+		owner:    r.Owner("egress"),
+	}
+	r.Register(w)
+	return nil
+}
+
+type watcher struct {
+	table    int
+	priority int
+	retries  *reconcile.RetryQueue
+	owner    *state.Owner
+}
+
+// ruleRecord and routeRecord are how the rules and routes are kept in the
+// state store, with their table so a run using another one cleans them up.
+type ruleRecord struct {
+	Src      string `json:"src"`
+	Table    int    `json:"table"`
+	Priority int    `json:"priority"`
+}
+
+type routeRecord struct {
+	Dst   string `json:"dst"`
+	Gw    string `json:"gw"`
+	Type  int    `json:"type"`
+	Table int    `json:"table"`
+}
+
+func (w *watcher) Name() string {
+	return "egress"
+}
+
+func (w *watcher) Retries() *reconcile.RetryQueue {
+	return w.retries
+}
+
+func (w *watcher) Reconcile(s *reconcile.Snapshot) error {
+	logrus.Debug("Evaluating egress routes")
+	defer w.retries.Prune()
+	desiredRules, desiredRoutes := w.getDesired(s)
+	if len(desiredRules) == 0 && len(desiredRoutes) == 0 && len(w.owner.Keys(ruleKind)) == 0 && len(w.owner.Keys(routeKind)) == 0 {
+		return nil
+	}
+	var optErr reconcile.MultiError
+	w.updateRoutes(desiredRoutes, &optErr)
+	w.updateRules(desiredRules, &optErr)
+	return errors.Wrap(optErr.ErrorOrNil(), "Failed to apply egress routes")
+}
+
+// getDesired returns a rule by local egress container and, when there's one,
+// the table routing to the gateway everything but the cluster subnets and
+// hosts. The gateway itself needs neither.
+func (w *watcher) getDesired(s *reconcile.Snapshot) (map[string]*netlink.Rule, map[string]*netlink.Route) {
+	rules := map[string]*netlink.Rule{}
+	routes := map[string]*netlink.Route{}
+	gateway, _, ok := Gateway(s)
+	if !ok || gateway.UUID == s.SelfHost.UUID {
+		return rules, routes
+	}
+	gw := net.ParseIP(routeupdate.AgentIP(gateway)).To4()
+	if gw == nil {
+		logrus.Warnf("Invalid agent IP %q on egress gateway %s, not routing egress traffic", routeupdate.AgentIP(gateway), gateway.Name)
+		return rules, routes
+	}
+	for source := range Sources(s, s.SelfHost.UUID) {
+		_, src, _ := net.ParseCIDR(source)
+		rule := netlink.NewRule()
+		rule.Src = src
+		rule.Table = w.table
+		rule.Priority = w.priority
+		rules[ruleKey(rule)] = rule
+	}
+	if len(rules) == 0 {
+		return rules, routes
+	}
+
+	throw := func(dst *net.IPNet) {
+		r := &netlink.Route{
+			Dst:   dst,
+			Type:  syscall.RTN_THROW,
+			Table: w.table,
+		}
+		routes[routeKey(r)] = r
+	}
+	_, ll, _ := net.ParseCIDR(linkLocal)
+	throw(ll)
+	for _, h := range s.Hosts {
+		if _, subnet, err := net.ParseCIDR(h.Labels[setting.SubnetLabel]); err == nil {
+			throw(subnet)
+		}
+		if ip := net.ParseIP(routeupdate.AgentIP(h)).To4(); ip != nil {
+			throw(&net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)})
+		}
+	}
+	_, all, _ := net.ParseCIDR("0.0.0.0/0")
+	r := &netlink.Route{
+		Dst:   all,
+		Gw:    gw,
+		Table: w.table,
+	}
+	routes[routeKey(r)] = r
+	return rules, routes
+}
+
+func (w *watcher) updateRoutes(desired map[string]*netlink.Route, optErr *reconcile.MultiError) {
+	existRoutes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: w.table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		optErr.Add("list routes", fmt.Sprintf("table %d", w.table), err)
+		return
+	}
+	current := map[string]*netlink.Route{}
+	for i := range existRoutes {
+		current[routeKey(&existRoutes[i])] = &existRoutes[i]
+	}
+	// Routes recorded in another table, and records of routes removed
+	// behind our back.
+	for _, key := range w.owner.Keys(routeKind) {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		var rec routeRecord
+		if err := w.owner.Get(routeKind, key, &rec); err != nil || rec.Table == w.table {
+			optErr.Add("forget route", key, w.owner.Remove(routeKind, key))
+			continue
+		}
+		_, dst, _ := net.ParseCIDR(rec.Dst)
+		current[key] = &netlink.Route{
+			Dst:   dst,
+			Gw:    net.ParseIP(rec.Gw),
+			Type:  rec.Type,
+			Table: rec.Table,
+		}
+	}
+
+	// The table may be shared, only what was recorded is removed.
+	for key, r := range current {
+		if _, ok := desired[key]; ok || !w.owner.Has(routeKind, key) || !w.retries.Ready("del route", key) {
+			continue
+		}
+		err := netlink.RouteDel(r)
+		if err == nil || err == syscall.ESRCH {
+			err = w.owner.Remove(routeKind, key)
+		}
+		w.retries.Done("del route", key, err)
+		optErr.Add("del route", key, err)
+	}
+	for key, r := range desired {
+		if _, ok := current[key]; ok {
+			if !w.owner.Has(routeKind, key) {
+				optErr.Add("record route", key, w.owner.Add(routeKind, key, newRouteRecord(r)))
+			}
+			continue
+		}
+		if !w.retries.Ready("add route", key) {
+			continue
+		}
+		err := netlink.RouteAdd(r)
+		if err == nil {
+			err = w.owner.Add(routeKind, key, newRouteRecord(r))
+		}
+		w.retries.Done("add route", key, err)
+		optErr.Add("add route", key, err)
+	}
+}
+
+func (w *watcher) updateRules(desired map[string]*netlink.Rule, optErr *reconcile.MultiError) {
+	existRules, err := netlink.RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		optErr.Add("list rules", fmt.Sprintf("table %d", w.table), err)
+		return
+	}
+	current := map[string]*netlink.Rule{}
+	for i, r := range existRules {
+		if r.Table == w.table && r.Priority == w.priority && r.Src != nil {
+			current[ruleKey(&existRules[i])] = &existRules[i]
+		}
+	}
+	for _, key := range w.owner.Keys(ruleKind) {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		var rec ruleRecord
+		if err := w.owner.Get(ruleKind, key, &rec); err != nil || (rec.Table == w.table && rec.Priority == w.priority) {
+			optErr.Add("forget rule", key, w.owner.Remove(ruleKind, key))
+			continue
+		}
+		_, src, _ := net.ParseCIDR(rec.Src)
+		rule := netlink.NewRule()
+		rule.Src = src
+		rule.Table = rec.Table
+		rule.Priority = rec.Priority
+		current[key] = rule
+	}
+
+	for key, r := range current {
+		if _, ok := desired[key]; ok || !w.retries.Ready("del rule", key) {
+			continue
+		}
+		err := ruleDel(r)
+		if err == nil || err == syscall.ENOENT {
+			err = w.owner.Remove(ruleKind, key)
+		}
+		w.retries.Done("del rule", key, err)
+		optErr.Add("del rule", key, err)
+	}
+	for key, r := range desired {
+		if _, ok := current[key]; ok {
+			if !w.owner.Has(ruleKind, key) {
+				optErr.Add("record rule", key, w.owner.Add(ruleKind, key, newRuleRecord(r)))
+			}
+			continue
+		}
+		if !w.retries.Ready("add rule", key) {
+			continue
+		}
+		err := netlink.RuleAdd(r)
+		if err == nil {
+			err = w.owner.Add(ruleKind, key, newRuleRecord(r))
+		}
+		w.retries.Done("add rule", key, err)
+		optErr.Add("add rule", key, err)
+	}
+}
+
+// ruleDel deletes r as netlink.RuleDel does, without the create flags
+// recent kernels refuse on a delete.
+func ruleDel(r *netlink.Rule) error {
+	req := nl.NewNetlinkRequest(syscall.RTM_DELRULE, syscall.NLM_F_ACK)
+	msg := nl.NewRtMsg()
+	msg.Family = syscall.AF_INET
+	msg.Table = syscall.RT_TABLE_UNSPEC
+	srcLen, _ := r.Src.Mask.Size()
+	msg.Src_len = uint8(srcLen)
+	req.AddData(msg)
+	req.AddData(nl.NewRtAttr(syscall.RTA_SRC, r.Src.IP.To4()))
+
+	native := nl.NativeEndian()
+	b := make([]byte, 4)
+	native.PutUint32(b, uint32(r.Priority))
+	req.AddData(nl.NewRtAttr(nl.FRA_PRIORITY, b))
+	b = make([]byte, 4)
+	native.PutUint32(b, uint32(r.Table))
+	req.AddData(nl.NewRtAttr(nl.FRA_TABLE, b))
+	_, err := req.Execute(syscall.NETLINK_ROUTE, 0)
+	return err
+}
+
+func newRuleRecord(r *netlink.Rule) ruleRecord {
+	return ruleRecord{
+		Src:      r.Src.String(),
+		Table:    r.Table,
+		Priority: r.Priority,
+	}
+}
+
+func newRouteRecord(r *netlink.Route) routeRecord {
+	rec := routeRecord{
+		Dst:   "0.0.0.0/0",
+		Type:  r.Type,
+		Table: r.Table,
+	}
+	if r.Dst != nil {
+		rec.Dst = r.Dst.String()
+	}
+	if r.Gw != nil {
+		rec.Gw = r.Gw.String()
+	}
+	return rec
+}
+
+func ruleKey(r *netlink.Rule) string {
+	return fmt.Sprintf("from %s table %d priority %d", r.Src, r.Table, r.Priority)
+}
+
+func routeKey(r *netlink.Route) string {
+	// The kernel lists the default route without destination.
+	dst := "0.0.0.0/0"
+	if r.Dst != nil {
+		dst = r.Dst.String()
+	}
+	if r.Type == syscall.RTN_THROW {
+		return fmt.Sprintf("throw %s table %d", dst, r.Table)
+	}
+	return fmt.Sprintf("%s via %s table %d", dst, r.Gw, r.Table)
+}
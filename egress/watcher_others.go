@@ -0,0 +1,7 @@
+//+build !linux
+
+package egress
+
+import "github.com/rancher/per-host-subnet/reconcile"
+
+func Watch(r *reconcile.Reconciler, table, priority int) error { return nil }
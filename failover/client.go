@@ -0,0 +1,155 @@
+package failover
+
+import (
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+const (
+	// retryUnhealthyAfter is how long an endpoint that failed is skipped
+	// while another one works.
+	retryUnhealthyAfter = 30 * time.Second
+)
+
+// statusErrorRe matches the error the metadata client returns for a non-200
+// response, it doesn't have a type of its own.
+var statusErrorRe = regexp.MustCompile(`^Error (\d+) accessing `)
+
+// EndpointStatus is the health of one metadata endpoint.
+type EndpointStatus struct {
+	URL         string    `json:"url"`
+	Active      bool      `json:"active"`
+	Healthy     bool      `json:"healthy"`
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"lastError,omitempty"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	LastFailure time.Time `json:"lastFailure"`
+}
+
+type endpoint struct {
+	metadata.Client
+	status EndpointStatus
+}
+
+// Client is a metadata.Client backed by a list of metadata endpoints. It
+// sticks to the endpoint that last answered so consecutive requests see the
+// same metadata, and moves to the next one, in order, when it can't be
+// reached.
+type Client struct {
+	sync.Mutex
+	endpoints []*endpoint
+	active    int
+}
+
+func NewClient(urls []string) *Client {
+	c := &Client{}
+	for _, u := range urls {
+		c.endpoints = append(c.endpoints, &endpoint{
+			Client: metadata.NewClient(u),
+			status: EndpointStatus{
+				URL:     u,
+				Healthy: true,
+			},
+		})
+	}
+	return c
+}
+
+func (c *Client) Endpoints() []EndpointStatus {
+	c.Lock()
+	defer c.Unlock()
+	var rtn []EndpointStatus
+	for i, e := range c.endpoints {
+		s := e.status
+		s.Active = i == c.active
+		rtn = append(rtn, s)
+	}
+	return rtn
+}
+
+// candidates returns the endpoints to try, the active one first, then the
+// others in order, keeping those that failed recently for last.
+func (c *Client) candidates() []int {
+	c.Lock()
+	defer c.Unlock()
+	rtn := []int{c.active}
+	var unhealthy []int
+	for i, e := range c.endpoints {
+		if i == c.active {
+			continue
+		}
+		if !e.status.Healthy && time.Since(e.status.LastFailure) < retryUnhealthyAfter {
+			unhealthy = append(unhealthy, i)
+			continue
+		}
+		rtn = append(rtn, i)
+	}
+	return append(rtn, unhealthy...)
+}
+
+func (c *Client) do(f func(m metadata.Client) error) error {
+	var err error
+	for _, i := range c.candidates() {
+		e := c.endpoints[i]
+		err = f(e.Client)
+		if err != nil && isUnreachable(err) {
+			c.failed(i, err)
+			continue
+		}
+		c.succeeded(i)
+		return err
+	}
+	return errors.Wrap(err, "All metadata endpoints failed")
+}
+
+func (c *Client) failed(i int, err error) {
+	c.Lock()
+	defer c.Unlock()
+	s := &c.endpoints[i].status
+	if s.Healthy {
+		logrus.Warnf("Metadata endpoint %s is unreachable: %v", s.URL, err)
+	}
+	s.Healthy = false
+	s.Failures++
+	s.LastError = err.Error()
+	s.LastFailure = time.Now()
+}
+
+func (c *Client) succeeded(i int) {
+	c.Lock()
+	defer c.Unlock()
+	s := &c.endpoints[i].status
+	if !s.Healthy {
+		logrus.Infof("Metadata endpoint %s is reachable again", s.URL)
+	}
+	s.Healthy = true
+	s.Failures = 0
+	s.LastError = ""
+	s.LastSuccess = time.Now()
+	if c.active != i {
+		logrus.Infof("Switching to metadata endpoint %s", s.URL)
+		c.active = i
+	}
+}
+
+// isUnreachable tells transport errors and 5xx responses, worth trying
+// another endpoint for, from errors the metadata service answered with.
+func isUnreachable(err error) bool {
+	switch err.(type) {
+	case *url.Error, net.Error:
+		return true
+	}
+	if m := statusErrorRe.FindStringSubmatch(err.Error()); m != nil {
+		code, _ := strconv.Atoi(m[1])
+		return code >= 500
+	}
+	return false
+}
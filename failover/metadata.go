@@ -0,0 +1,144 @@
+package failover
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+func (c *Client) OnChangeWithError(intervalSeconds int, do func(string)) error {
+	version := "init"
+	for {
+		newVersion, err := c.GetVersion()
+		if err != nil {
+			return err
+		}
+		if newVersion != version {
+			version = newVersion
+			do(version)
+		}
+		time.Sleep(time.Duration(intervalSeconds) * time.Second)
+	}
+}
+
+func (c *Client) OnChange(intervalSeconds int, do func(string)) {
+	for {
+		if err := c.OnChangeWithError(intervalSeconds, do); err != nil {
+			logrus.Errorf("Error reading metadata version: %v", err)
+		}
+		time.Sleep(time.Duration(intervalSeconds) * time.Second)
+	}
+}
+
+func (c *Client) SendRequest(path string) (resp []byte, err error) {
+	err = c.do(func(m metadata.Client) (err error) {
+		resp, err = m.SendRequest(path)
+		return
+	})
+	return
+}
+
+func (c *Client) GetVersion() (version string, err error) {
+	err = c.do(func(m metadata.Client) (err error) {
+		version, err = m.GetVersion()
+		return
+	})
+	return
+}
+
+func (c *Client) GetSelfHost() (host metadata.Host, err error) {
+	err = c.do(func(m metadata.Client) (err error) {
+		host, err = m.GetSelfHost()
+		return
+	})
+	return
+}
+
+func (c *Client) GetSelfContainer() (container metadata.Container, err error) {
+	err = c.do(func(m metadata.Client) (err error) {
+		container, err = m.GetSelfContainer()
+		return
+	})
+	return
+}
+
+func (c *Client) GetSelfServiceByName(name string) (service metadata.Service, err error) {
+	err = c.do(func(m metadata.Client) (err error) {
+		service, err = m.GetSelfServiceByName(name)
+		return
+	})
+	return
+}
+
+func (c *Client) GetSelfService() (service metadata.Service, err error) {
+	err = c.do(func(m metadata.Client) (err error) {
+		service, err = m.GetSelfService()
+		return
+	})
+	return
+}
+
+func (c *Client) GetSelfStack() (stack metadata.Stack, err error) {
+	err = c.do(func(m metadata.Client) (err error) {
+		stack, err = m.GetSelfStack()
+		return
+	})
+	return
+}
+
+func (c *Client) GetServices() (services []metadata.Service, err error) {
+	err = c.do(func(m metadata.Client) (err error) {
+		services, err = m.GetServices()
+		return
+	})
+	return
+}
+
+func (c *Client) GetStacks() (stacks []metadata.Stack, err error) {
+	err = c.do(func(m metadata.Client) (err error) {
+		stacks, err = m.GetStacks()
+		return
+	})
+	return
+}
+
+func (c *Client) GetContainers() (containers []metadata.Container, err error) {
+	err = c.do(func(m metadata.Client) (err error) {
+		containers, err = m.GetContainers()
+		return
+	})
+	return
+}
+
+func (c *Client) GetServiceContainers(serviceName string, stackName string) (containers []metadata.Container, err error) {
+	err = c.do(func(m metadata.Client) (err error) {
+		containers, err = m.GetServiceContainers(serviceName, stackName)
+		return
+	})
+	return
+}
+
+func (c *Client) GetHosts() (hosts []metadata.Host, err error) {
+	err = c.do(func(m metadata.Client) (err error) {
+		hosts, err = m.GetHosts()
+		return
+	})
+	return
+}
+
+func (c *Client) GetHost(UUID string) (host metadata.Host, err error) {
+	err = c.do(func(m metadata.Client) (err error) {
+		host, err = m.GetHost(UUID)
+		return
+	})
+	return
+}
+
+func (c *Client) GetNetworks() (networks []metadata.Network, err error) {
+	err = c.do(func(m metadata.Client) (err error) {
+		networks, err = m.GetNetworks()
+		return
+	})
+	return
+}
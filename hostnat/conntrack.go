@@ -0,0 +1,53 @@
+//+build !windows
+
+package hostnat
+
+import (
+	"net"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/per-host-subnet/conntrack"
+	"github.com/rancher/per-host-subnet/reconcile"
+	"github.com/rancher/per-host-subnet/setting"
+)
+
+// deleteConntrack deletes the connections from the NAT sources to the
+// subnets whose NAT treatment changed, when enabled. A failure is only
+// logged, the set is already in place and the connections eventually time
+// out.
+func (w *watcher) deleteConntrack(entries []string) {
+	if !w.flushConntrack || len(entries) == 0 {
+		return
+	}
+	var subnets []*net.IPNet
+	for _, e := range entries {
+		if _, subnet, err := net.ParseCIDR(e); err == nil {
+			subnets = append(subnets, subnet)
+		}
+	}
+	n, err := conntrack.Delete(w.natSources, subnets)
+	if err != nil {
+		logrus.Warnf("hostnat: failed to delete the conntrack entries to %v: %v", entries, err)
+		return
+	}
+	logrus.Infof("hostnat: deleted %d conntrack entries to %v", n, entries)
+}
+
+// getNATSources returns the sources the exempt set decides the NAT of: the
+// local subnet and, on the egress gateway, the egress containers.
+func getNATSources(s *reconcile.Snapshot) []*net.IPNet {
+	var sources []*net.IPNet
+	if _, subnet, err := net.ParseCIDR(s.SelfHost.Labels[setting.SubnetLabel]); err == nil {
+		sources = append(sources, subnet)
+	}
+	egressSources, egressSNAT := getDesiredEgressEntries(s)
+	if egressSNAT == nil {
+		return sources
+	}
+	for e := range egressSources {
+		if _, subnet, err := net.ParseCIDR(e); err == nil {
+			sources = append(sources, subnet)
+		}
+	}
+	return sources
+}
@@ -0,0 +1,69 @@
+//+build !windows
+
+package hostnat
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/per-host-subnet/egress"
+	"github.com/rancher/per-host-subnet/reconcile"
+	"github.com/rancher/per-host-subnet/setting"
+)
+
+// getDesiredSourceEntries returns the addresses of the local containers opted
+// out of host NAT, and of those masqueraded even towards exempted subnets. A
+// container with both labels isn't masqueraded.
+func getDesiredSourceEntries(s *reconcile.Snapshot) (noMasq, forceMasq map[string]bool) {
+	noMasq = map[string]bool{}
+	forceMasq = map[string]bool{}
+	for _, c := range s.Containers {
+		if c.HostUUID != s.SelfHost.UUID {
+			continue
+		}
+		if !(c.State == "running" || c.State == "starting" || c.State == "stopping") {
+			continue
+		}
+		no, force := labelSet(c.Labels, setting.NoMasqueradeLabel), labelSet(c.Labels, setting.ForceMasqueradeLabel)
+		if !no && !force {
+			continue
+		}
+		ip := net.ParseIP(c.PrimaryIp).To4()
+		if ip == nil {
+			logrus.Warnf("Invalid container %s primary IP %q, skipping its NAT labels", c.Name, c.PrimaryIp)
+			continue
+		}
+		entry := (&net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}).String()
+		switch {
+		case no && force:
+			logrus.Warnf("Container %s has both %s and %s, not masquerading it", c.Name, setting.NoMasqueradeLabel, setting.ForceMasqueradeLabel)
+			noMasq[entry] = true
+		case no:
+			noMasq[entry] = true
+		case force:
+			forceMasq[entry] = true
+		}
+	}
+	return noMasq, forceMasq
+}
+
+// getDesiredEgressEntries returns, when the local host is the egress gateway,
+// the egress containers of every host and the address to SNAT them to. Other
+// hosts get their local egress containers, routed to the gateway, which must
+// see their addresses.
+func getDesiredEgressEntries(s *reconcile.Snapshot) (map[string]bool, net.IP) {
+	gateway, snat, ok := egress.Gateway(s)
+	if !ok {
+		return map[string]bool{}, nil
+	}
+	if gateway.UUID != s.SelfHost.UUID {
+		return egress.Sources(s, s.SelfHost.UUID), nil
+	}
+	return egress.Sources(s, ""), snat
+}
+
+func labelSet(labels map[string]string, key string) bool {
+	b, _ := strconv.ParseBool(labels[key])
+	return b
+}
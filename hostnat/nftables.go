@@ -0,0 +1,216 @@
+//+build !windows
+
+package hostnat
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/per-host-subnet/nftables"
+	"github.com/rancher/per-host-subnet/reconcile"
+	"github.com/rancher/per-host-subnet/setting"
+)
+
+const (
+	tableKind = "nftables table"
+
+	replaceTableOp = "replace table"
+
+	nftSet          = "nat_exempt"
+	nftNoMasqSet    = "no_masquerade"
+	nftForceMasqSet = "force_masquerade"
+	nftEgressSet    = "egress"
+	nftChain        = "postrouting"
+	nftBase         = "type nat hook postrouting priority 100; policy accept;"
+)
+
+// tableRecord is how the NAT table is kept in the state store. RulesHash is
+// the hash of the rules it was written with, the rules nft lists can't be
+// compared to them as every nft version prints rules its own way.
+type tableRecord struct {
+	Family    string `json:"family"`
+	RulesHash string `json:"rulesHash,omitempty"`
+}
+
+// refreshTable keeps the NAT table holding the exempted subnets and the
+// opted out or in containers sets and the chain masquerading the local
+// subnet traffic, the nftables counterpart of refreshIPSet and refreshRules.
+// The table is replaced as a whole, when a set differs, when the rules
+// differ from those recorded or when the chain doesn't hold as many rules.
+func (w *watcher) refreshTable(s *reconcile.Snapshot) error {
+	t, err := w.nft.Get(nftables.FamilyIP, w.tableName)
+	if err != nil {
+		return err
+	}
+	current, rules, err := tableEntries(t)
+	if err != nil {
+		return err
+	}
+	exempt, noPeers := w.getDesiredIPSetEntries(s)
+	desired := map[string]map[string]bool{
+		nftSet: dropCovered(exempt),
+	}
+	desired[nftNoMasqSet], desired[nftForceMasqSet] = getDesiredSourceEntries(s)
+	var egressSNAT net.IP
+	desired[nftEgressSet], egressSNAT = getDesiredEgressEntries(s)
+	desiredRules := w.getDesiredTableRules(s.SelfHost, egressSNAT)
+	rulesHash := hashRules(desiredRules)
+	// A record without the hash, or none, means the rules are unknown.
+	var record tableRecord
+	w.owner.Get(tableKind, w.tableName, &record)
+
+	toAddEntries, toDelEntries := diffEntries(w.guard, s.Version, current[nftSet], desired[nftSet], noPeers)
+	changed := t == nil || len(toAddEntries) > 0 || len(toDelEntries) > 0 || len(rules) != len(desiredRules) || record.RulesHash != rulesHash
+	for _, name := range []string{nftNoMasqSet, nftForceMasqSet, nftEgressSet} {
+		toAdd, toDel := diffEntries(nil, s.Version, current[name], desired[name], false)
+		changed = changed || len(toAdd) > 0 || len(toDel) > 0
+	}
+	if !changed {
+		return nil
+	}
+
+	if !w.retries.Ready(replaceTableOp, w.tableName) {
+		return nil
+	}
+	if !w.owner.Has(tableKind, w.tableName) {
+		if err := w.owner.Add(tableKind, w.tableName, tableRecord{Family: nftables.FamilyIP}); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("hostnat: replacing table %s, adding %v and deleting %v", w.tableName, toAddEntries, toDelEntries)
+	table := &nftables.Table{
+		Family: nftables.FamilyIP,
+		Name:   w.tableName,
+		Chains: []nftables.Chain{{
+			Name:  nftChain,
+			Base:  nftBase,
+			Rules: desiredRules,
+		}},
+	}
+	for _, name := range []string{nftSet, nftNoMasqSet, nftForceMasqSet, nftEgressSet} {
+		var elements []string
+		for e := range desired[name] {
+			elements = append(elements, e)
+		}
+		sort.Strings(elements)
+		table.Sets = append(table.Sets, nftables.Set{
+			Name:     name,
+			Type:     "ipv4_addr",
+			Flags:    "interval",
+			Elements: elements,
+		})
+	}
+	err = w.nft.Replace(table)
+	w.retries.Done(replaceTableOp, w.tableName, err)
+	if err != nil {
+		return err
+	}
+	w.deleteConntrack(append(toAddEntries, toDelEntries...))
+	return w.owner.Add(tableKind, w.tableName, tableRecord{Family: nftables.FamilyIP, RulesHash: rulesHash})
+}
+
+func hashRules(rules []string) string {
+	h := sha256.Sum256([]byte(strings.Join(rules, "\n")))
+	return hex.EncodeToString(h[:])
+}
+
+// tableEntries returns the entries of every set of t, and its NAT rules.
+func tableEntries(t *nftables.Table) (map[string]map[string]bool, []string, error) {
+	entries := map[string]map[string]bool{}
+	var rules []string
+	if t == nil {
+		return entries, nil, nil
+	}
+	for _, s := range t.Sets {
+		entries[s.Name] = map[string]bool{}
+		for _, e := range s.Elements {
+			// nft prints a /32 as a bare address.
+			if !strings.Contains(e, "/") {
+				e += "/32"
+			}
+			_, subnet, err := net.ParseCIDR(e)
+			if err != nil {
+				return nil, nil, errors.Wrapf(err, "Failed to parse table %s set element", t.Name)
+			}
+			entries[s.Name][subnet.String()] = true
+		}
+	}
+	for _, c := range t.Chains {
+		if c.Name == nftChain {
+			rules = c.Rules
+		}
+	}
+	return entries, rules, nil
+}
+
+// dropCovered removes the entries within another one, nft refuses
+// overlapping intervals.
+func dropCovered(entries map[string]bool) map[string]bool {
+	rtn := map[string]bool{}
+	for e := range entries {
+		_, subnet, _ := net.ParseCIDR(e)
+		ones, _ := subnet.Mask.Size()
+		covered := false
+		for o := range entries {
+			_, other, _ := net.ParseCIDR(o)
+			otherOnes, _ := other.Mask.Size()
+			if otherOnes < ones && other.Contains(subnet.IP) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			rtn[e] = true
+		}
+	}
+	return rtn
+}
+
+// getDesiredTableRules mirrors getDesiredRules.
+func (w *watcher) getDesiredTableRules(selfHost metadata.Host, egressSNAT net.IP) []string {
+	_, subnet, err := net.ParseCIDR(selfHost.Labels[setting.SubnetLabel])
+	if err != nil {
+		logrus.Warnf("Failed to parse local host subnet, not masquerading: %v", err)
+		return nil
+	}
+	target := "masquerade"
+	if ip := snatAddress(selfHost); ip != nil {
+		target = "snat to " + ip.String()
+	}
+	egress := "ip saddr @" + nftEgressSet + " return"
+	if egressSNAT != nil {
+		egress = "ip saddr @" + nftEgressSet + " ip daddr != " + subnet.String() + " ip daddr != @" + nftSet + " snat to " + egressSNAT.String()
+	}
+	return []string{
+		egress,
+		"ip saddr @" + nftNoMasqSet + " return",
+		"ip saddr @" + nftForceMasqSet + " ip daddr != " + subnet.String() + " " + target,
+		"ip saddr " + subnet.String() + " ip daddr @" + nftSet + " return",
+		"ip saddr " + subnet.String() + " ip daddr != " + subnet.String() + " " + target,
+	}
+}
+
+// cleanupTables deletes the tables a previous run created under another name.
+func (w *watcher) cleanupTables() error {
+	if w.nft == nil {
+		return nil
+	}
+	var optErr reconcile.MultiError
+	for _, name := range w.owner.Keys(tableKind) {
+		if name == w.tableName {
+			continue
+		}
+		if err := w.nft.Delete(nftables.FamilyIP, name); err != nil {
+			optErr.Add("delete table", name, err)
+			continue
+		}
+		optErr.Add("forget table", name, w.owner.Remove(tableKind, name))
+	}
+	return optErr.ErrorOrNil()
+}
@@ -0,0 +1,131 @@
+//+build !windows
+
+package hostnat
+
+import (
+	"net"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/per-host-subnet/iptables"
+	"github.com/rancher/per-host-subnet/reconcile"
+	"github.com/rancher/per-host-subnet/setting"
+)
+
+const (
+	chainKind = "iptables chain"
+	jumpKind  = "iptables jump"
+)
+
+// refreshRules makes the NAT chain return for the local subnet traffic to the
+// ipset members and masquerade the rest of it leaving the subnet, except for
+// the containers opted out of or into masquerading whatever the destination.
+// Traffic is SNATed to the address of the local host label, when set. On the
+// egress gateway, egress traffic leaving the cluster is SNATed to egressSNAT
+// first, elsewhere it's left alone on its way to the gateway. The chain is
+// jumped to first thing in POSTROUTING. Both are checked on every pass so a
+// flushed table is restored.
+func (w *watcher) refreshRules(selfHost metadata.Host, egressSNAT net.IP) error {
+	desired := w.getDesiredRules(selfHost, egressSNAT)
+	current, exists, err := w.iptables.Rules(iptables.TableNAT, w.chainName)
+	if err != nil {
+		return err
+	}
+	if !exists || strings.Join(current, "\n") != strings.Join(desired, "\n") {
+		if !w.owner.Has(chainKind, w.chainName) {
+			if err := w.owner.Add(chainKind, w.chainName, iptables.TableNAT); err != nil {
+				return err
+			}
+		}
+		logrus.Infof("hostnat: setting chain %s rules to %v", w.chainName, desired)
+		if err := w.iptables.ReplaceChain(iptables.TableNAT, w.chainName, desired); err != nil {
+			return err
+		}
+	}
+
+	jump := jumpRule(w.chainName)
+	ok, err := w.iptables.Exists(iptables.TableNAT, iptables.ChainPostrouting, jump)
+	if err != nil || ok {
+		return err
+	}
+	if !w.owner.Has(jumpKind, w.chainName) {
+		if err := w.owner.Add(jumpKind, w.chainName, jump); err != nil {
+			return err
+		}
+	}
+	logrus.Infof("hostnat: inserting %s rule %s", iptables.ChainPostrouting, jump)
+	return w.iptables.Insert(iptables.TableNAT, iptables.ChainPostrouting, 1, jump)
+}
+
+// getDesiredRules returns no rule while the local host has no valid subnet,
+// the chain is kept so the jump to it stays valid.
+func (w *watcher) getDesiredRules(selfHost metadata.Host, egressSNAT net.IP) []string {
+	_, subnet, err := net.ParseCIDR(selfHost.Labels[setting.SubnetLabel])
+	if err != nil {
+		logrus.Warnf("Failed to parse local host subnet, not masquerading: %v", err)
+		return nil
+	}
+	target := "-j MASQUERADE"
+	if ip := snatAddress(selfHost); ip != nil {
+		target = "-j SNAT --to-source " + ip.String()
+	}
+	egress := "-m set --match-set " + w.egressIPSet + " src -j RETURN"
+	if egressSNAT != nil {
+		egress = "! -d " + subnet.String() + " -m set --match-set " + w.egressIPSet + " src -m set ! --match-set " + w.ipsetName + " dst -j SNAT --to-source " + egressSNAT.String()
+	}
+	return []string{
+		egress,
+		"-m set --match-set " + w.noMasqIPSet + " src -j RETURN",
+		"-s " + subnet.String() + " ! -d " + subnet.String() + " -m set --match-set " + w.forceMasqIPSet + " src " + target,
+		"-s " + subnet.String() + " -m set --match-set " + w.ipsetName + " dst -j RETURN",
+		"-s " + subnet.String() + " ! -d " + subnet.String() + " " + target,
+	}
+}
+
+// snatAddress returns the source address the local host label asks for
+// instead of the outgoing interface one, nil when unset or invalid.
+func snatAddress(selfHost metadata.Host) net.IP {
+	v, ok := selfHost.Labels[setting.SNATAddressLabel]
+	if !ok || v == "" {
+		return nil
+	}
+	ip := net.ParseIP(v).To4()
+	if ip == nil {
+		logrus.Warnf("Invalid local host %s label %q, masquerading instead", setting.SNATAddressLabel, v)
+	}
+	return ip
+}
+
+// cleanupRules removes the chains a previous run created under another name.
+func (w *watcher) cleanupRules() error {
+	if w.iptables == nil {
+		return nil
+	}
+	var optErr reconcile.MultiError
+	for _, name := range w.owner.Keys(jumpKind) {
+		if name == w.chainName {
+			continue
+		}
+		if err := w.iptables.Delete(iptables.TableNAT, iptables.ChainPostrouting, jumpRule(name)); err != nil {
+			optErr.Add("delete jump", name, err)
+			continue
+		}
+		optErr.Add("forget jump", name, w.owner.Remove(jumpKind, name))
+	}
+	for _, name := range w.owner.Keys(chainKind) {
+		if name == w.chainName || w.owner.Has(jumpKind, name) {
+			continue
+		}
+		if err := w.iptables.DeleteChain(iptables.TableNAT, name); err != nil {
+			optErr.Add("delete chain", name, err)
+			continue
+		}
+		optErr.Add("forget chain", name, w.owner.Remove(chainKind, name))
+	}
+	return optErr.ErrorOrNil()
+}
+
+func jumpRule(chain string) string {
+	return "-j " + chain
+}
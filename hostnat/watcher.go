@@ -3,93 +3,306 @@
 package hostnat
 
 import (
-	"os/exec"
+	"fmt"
+	"net"
+	"strings"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
-	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/per-host-subnet/ipset"
+	"github.com/rancher/per-host-subnet/iptables"
+	"github.com/rancher/per-host-subnet/nftables"
+	"github.com/rancher/per-host-subnet/reconcile"
 	"github.com/rancher/per-host-subnet/setting"
+	"github.com/rancher/per-host-subnet/state"
 )
 
 const (
-	perHostSubnetLabel = "io.rancher.network.per_host_subnet.subnet"
+	ipsetKind       = "ipset"
+	ipsetMemberKind = "ipset member"
+
+	replaceOp  = "replace ipset"
+	addEntryOp = "add ipset entry"
 )
 
-func Watch(c metadata.Client) error {
-	ipsetPath, err := exec.LookPath("ipset")
-	if err != nil {
-		return errors.Wrap(err, "Failed to lookup ipset")
-	}
+// Watch keeps the NAT exemption set and the NAT rules using it up to date,
+// with iptables and an ipset managed through the ipset backend named
+// ipsetBackend, or with nftables, as natBackend tells. With flushConntrack,
+// the connections it NATs to the subnets added to or removed from the set
+// are forgotten so they follow the new NAT decision.
+func Watch(r *reconcile.Reconciler, natBackend, ipsetBackend string, flushConntrack bool) error {
 	w := &watcher{
-		c:         c,
-		ipsetName: setting.DefaultDisableHostNATIPset,
-		ipsetPath: ipsetPath,
+		backend:        natBackend,
+		flushConntrack: flushConntrack,
+		retries:        r.NewRetryQueue(),
+		guard:          r.NewDeleteGuard("hostnat"),
+		owner:          r.Owner("hostnat"),
+	}
+	var err error
+	switch natBackend {
+	case setting.NATBackendIPTables:
+		if w.ipsets, err = ipset.New(ipsetBackend); err != nil {
+			return err
+		}
+		logrus.Infof("hostnat: using the %s ipset backend", w.ipsets.Name())
+		if w.iptables, err = iptables.New(); err != nil {
+			return err
+		}
+		// Only needed to clean up after the nftables backend.
+		w.nft, _ = nftables.New()
+	case setting.NATBackendNFTables:
+		if w.nft, err = nftables.New(); err != nil {
+			return err
+		}
+		// Only needed to clean up after the iptables backend, hosts
+		// running nftables alone may have neither.
+		w.ipsets, _ = ipset.New(ipsetBackend)
+		w.iptables, _ = iptables.New()
+	default:
+		return errors.Errorf("Unknown NAT backend %s, expected %s or %s", natBackend, setting.NATBackendIPTables, setting.NATBackendNFTables)
 	}
-	go c.OnChange(5, w.onChangeNoError)
+	logrus.Infof("hostnat: using the %s NAT backend", natBackend)
+	r.Register(w)
 	return nil
 }
 
 type watcher struct {
-	c         metadata.Client
+	backend   string
 	ipsetName string
-	ipsetPath string
+	chainName string
+	tableName string
+	ipsets    ipset.Interface
+	iptables  *iptables.IPTables
+	nft       *nftables.NFTables
+	retries   *reconcile.RetryQueue
+	guard     *reconcile.DeleteGuard
+	owner     *state.Owner
+
+	// noMasqIPSet and forceMasqIPSet hold the local containers opted out
+	// of host NAT and those always masqueraded, egressIPSet the egress
+	// containers of every host on the egress gateway, the local ones
+	// elsewhere.
+	noMasqIPSet    string
+	forceMasqIPSet string
+	egressIPSet    string
+
+	flushConntrack bool
+	// natSources are the sources of the connections deleted along with
+	// the exempt set changes, set by every pass.
+	natSources []*net.IPNet
 }
 
-func (w *watcher) onChangeNoError(version string) {
-	if err := w.onChange(version); err != nil {
-		logrus.Errorf("Failed to apply ipset: %v", err)
-	}
+func (w *watcher) Name() string {
+	return "hostnat"
 }
 
-func (w *watcher) onChange(version string) error {
+func (w *watcher) Retries() *reconcile.RetryQueue {
+	return w.retries
+}
+
+func (w *watcher) Reconcile(s *reconcile.Snapshot) error {
 	logrus.Debug("Evaluating NAT ipset")
+	defer w.retries.Prune()
+	// A renamed set, chain or table is created first, the old ones are
+	// removed once nothing refers to them anymore. The objects of the
+	// backend not in use have no name and are all removed.
+	w.ipsetName, w.chainName, w.tableName = "", "", ""
+	w.noMasqIPSet, w.forceMasqIPSet, w.egressIPSet = "", "", ""
+	w.natSources = getNATSources(s)
+	// A failed entry doesn't hold back the rest of the pass.
+	var entryErrs reconcile.MultiError
+	switch w.backend {
+	case setting.NATBackendIPTables:
+		w.ipsetName = setting.NATIPSet
+		w.noMasqIPSet = setting.NoMasqueradeIPSet
+		w.forceMasqIPSet = setting.ForceMasqueradeIPSet
+		w.egressIPSet = setting.EgressIPSet
+		w.chainName = setting.NATChain
+		noMasq, forceMasq := getDesiredSourceEntries(s)
+		egressSources, egressSNAT := getDesiredEgressEntries(s)
+		exempt, noPeers := w.getDesiredIPSetEntries(s)
+		if err := w.refreshIPSet(s.Version, w.ipsetName, exempt, w.guard, noPeers, &entryErrs); err != nil {
+			return errors.Wrap(err, "Failed to apply ipset")
+		}
+		if err := w.refreshIPSet(s.Version, w.noMasqIPSet, noMasq, nil, false, &entryErrs); err != nil {
+			return errors.Wrap(err, "Failed to apply ipset")
+		}
+		if err := w.refreshIPSet(s.Version, w.forceMasqIPSet, forceMasq, nil, false, &entryErrs); err != nil {
+			return errors.Wrap(err, "Failed to apply ipset")
+		}
+		if err := w.refreshIPSet(s.Version, w.egressIPSet, egressSources, nil, false, &entryErrs); err != nil {
+			return errors.Wrap(err, "Failed to apply ipset")
+		}
+		if err := w.refreshRules(s.SelfHost, egressSNAT); err != nil {
+			return errors.Wrap(err, "Failed to apply NAT rules")
+		}
+	case setting.NATBackendNFTables:
+		w.tableName = setting.NATTable
+		if err := w.refreshTable(s); err != nil {
+			return errors.Wrap(err, "Failed to apply NAT table")
+		}
+	}
+	if err := w.cleanupTables(); err != nil {
+		return errors.Wrap(err, "Failed to clean up NAT tables")
+	}
+	if err := w.cleanupRules(); err != nil {
+		return errors.Wrap(err, "Failed to clean up NAT rules")
+	}
+	if err := w.cleanupIPSets(); err != nil {
+		return errors.Wrap(err, "Failed to clean up ipsets")
+	}
+	return errors.Wrap(entryErrs.ErrorOrNil(), "Failed to apply ipset entries")
+}
 
-	selfHost, err := w.c.GetSelfHost()
-	if err != nil {
+// cleanupIPSets destroys the sets a previous run created under another name.
+func (w *watcher) cleanupIPSets() error {
+	if w.ipsets == nil {
+		return nil
+	}
+	var optErr reconcile.MultiError
+	for _, name := range w.owner.Keys(ipsetKind) {
+		if name == w.ipsetName || name == w.noMasqIPSet || name == w.forceMasqIPSet || name == w.egressIPSet {
+			continue
+		}
+		if err := w.ipsets.Destroy(name); err != nil {
+			optErr.Add("destroy ipset", name, err)
+			continue
+		}
+		for _, key := range w.owner.Keys(ipsetMemberKind) {
+			if strings.HasPrefix(key, name+" ") {
+				optErr.Add("forget ipset entry", key, w.owner.Remove(ipsetMemberKind, key))
+			}
+		}
+		optErr.Add("forget ipset", name, w.owner.Remove(ipsetKind, name))
+	}
+	return optErr.ErrorOrNil()
+}
+
+// refreshIPSet makes the set name hold desired, deleting entries only when
+// guard, if any, allows it. noPeers tells the guard metadata listed no peer.
+// The entries failing to be added are recorded in entryErrs.
+func (w *watcher) refreshIPSet(version, name string, desired map[string]bool, guard *reconcile.DeleteGuard, noPeers bool, entryErrs *reconcile.MultiError) error {
+	if err := w.ipsets.Create(name, ipset.TypeHashNet); err != nil {
 		return err
 	}
+	if !w.owner.Has(ipsetKind, name) {
+		if err := w.owner.Add(ipsetKind, name, ipset.TypeHashNet); err != nil {
+			return err
+		}
+	}
 
-	allHosts, err := w.c.GetHosts()
+	current, err := w.getCurrentIPSetEntries(name)
 	if err != nil {
 		return err
 	}
 
-	return w.refreshIPSet(selfHost, allHosts)
-}
+	toAddEntries, toDelEntries := diffEntries(guard, version, current, desired, noPeers)
+	// Entries that failed to be added wait for their own backoff.
+	var readyEntries []string
+	for _, e := range toAddEntries {
+		if w.retries.Ready(addEntryOp, name+" "+e) {
+			readyEntries = append(readyEntries, e)
+		} else {
+			delete(desired, e)
+		}
+	}
+	toAddEntries = readyEntries
+	if len(toAddEntries) == 0 && len(toDelEntries) == 0 {
+		return nil
+	}
 
-func (w *watcher) refreshIPSet(selfHost metadata.Host, allHosts []metadata.Host) error {
-	out, err := exec.Command(w.ipsetPath, "create", "--exist", w.ipsetName, "hash:net").CombinedOutput()
-	if err != nil {
-		return errors.Wrapf(err, "Failed to create ipset: %s", out)
+	if !w.retries.Ready(replaceOp, name) {
+		return nil
+	}
+	logrus.Infof("hostnat: replacing ipset %s, adding %v and deleting %v", name, toAddEntries, toDelEntries)
+	err = w.replaceIPSet(name, desired, entryErrs)
+	w.retries.Done(replaceOp, name, err)
+	if err == nil && name == w.ipsetName {
+		changed := toDelEntries
+		for _, e := range toAddEntries {
+			if desired[e] {
+				changed = append(changed, e)
+			}
+		}
+		w.deleteConntrack(changed)
 	}
+	return err
+}
 
-	current, err := w.getCurrentIPSetEntries()
-	if err != nil {
+// replaceIPSet fills a temporary set with entries, in a single batch, and
+// swaps it with the live one, so the kernel sees either the old or the new
+// membership. The entries failing to be added are left out of the swap and of
+// entries, recorded in entryErrs and retried on their own backoff. The
+// temporary set is recorded in the state store so a leftover is destroyed by
+// cleanupIPSets, one left by a crash before the store was saved is flushed
+// and reused by the next replace.
+func (w *watcher) replaceIPSet(name string, entries map[string]bool, entryErrs *reconcile.MultiError) error {
+	tmpName := tmpIPSetName(name)
+	var optErr reconcile.MultiError
+	if err := w.owner.Add(ipsetKind, tmpName, ipset.TypeHashNet); err != nil {
 		return err
 	}
-	desired := w.getDesiredIPSetEntries(selfHost, allHosts)
+	defer func() {
+		if err := w.ipsets.Destroy(tmpName); err != nil {
+			logrus.Errorf("hostnat: failed to destroy temporary ipset %s: %v", tmpName, err)
+			return
+		}
+		if err := w.owner.Remove(ipsetKind, tmpName); err != nil {
+			logrus.Errorf("hostnat: failed to forget temporary ipset %s: %v", tmpName, err)
+		}
+	}()
 
-	toAddEntries, toDelEntries := w.diffIPSetEntries(current, desired)
+	// A set left by a crash may hold stale entries.
+	ops := []ipset.Op{
+		{Cmd: ipset.OpCreate, Set: tmpName, Arg: ipset.TypeHashNet},
+		{Cmd: ipset.OpFlush, Set: tmpName},
+	}
+	for e := range entries {
+		ops = append(ops, ipset.Op{Cmd: ipset.OpAdd, Set: tmpName, Arg: e})
+	}
+	errs := w.ipsets.Apply(ops)
+	if errs[0] != nil || errs[1] != nil {
+		optErr.Add("create ipset", tmpName, errs[0])
+		optErr.Add("flush ipset", tmpName, errs[1])
+		return optErr.ErrorOrNil()
+	}
+	for i, op := range ops[2:] {
+		w.retries.Done(addEntryOp, name+" "+op.Arg, errs[i+2])
+		if errs[i+2] != nil {
+			entryErrs.Add(addEntryOp, name+" "+op.Arg, errs[i+2])
+			delete(entries, op.Arg)
+		}
+	}
+	if err := w.ipsets.Swap(name, tmpName); err != nil {
+		return err
+	}
 
-	var optErr error
-	for _, e := range toAddEntries {
-		out, err = exec.Command(w.ipsetPath, "add", w.ipsetName, e, "-exist").CombinedOutput()
-		if err != nil {
-			optErr = errors.Wrap(optErr, err.Error())
-			continue
+	for _, key := range w.owner.Keys(ipsetMemberKind) {
+		if strings.HasPrefix(key, name+" ") && !entries[strings.TrimPrefix(key, name+" ")] {
+			optErr.Add("forget ipset entry", key, w.owner.Remove(ipsetMemberKind, key))
 		}
 	}
-	for _, e := range toDelEntries {
-		out, err = exec.Command(w.ipsetPath, "del", w.ipsetName, e, "-exist").CombinedOutput()
-		if err != nil {
-			optErr = errors.Wrap(optErr, err.Error())
-			continue
+	for e := range entries {
+		key := name + " " + e
+		if !w.owner.Has(ipsetMemberKind, key) {
+			optErr.Add("record ipset entry", key, w.owner.Add(ipsetMemberKind, key, e))
 		}
 	}
-	return optErr
+	return optErr.ErrorOrNil()
 }
 
-func (w *watcher) diffIPSetEntries(current map[string]bool, desired map[string]bool) (toAddEntries []string, toDelEntries []string) {
+// tmpIPSetName derives the temporary set name, within the name length limit.
+func tmpIPSetName(name string) string {
+	const suffix = "-tmp"
+	if len(name)+len(suffix) > ipset.MaxNameLen {
+		name = name[:ipset.MaxNameLen-len(suffix)]
+	}
+	return name + suffix
+}
+
+// diffEntries returns the entries to add and to delete. The ones guard, if
+// any, refuses to delete are kept in desired.
+func diffEntries(guard *reconcile.DeleteGuard, version string, current map[string]bool, desired map[string]bool, noPeers bool) (toAddEntries []string, toDelEntries []string) {
 	for e := range desired {
 		if _, ok := current[e]; !ok {
 			toAddEntries = append(toAddEntries, e)
@@ -100,33 +313,75 @@ func (w *watcher) diffIPSetEntries(current map[string]bool, desired map[string]b
 			toDelEntries = append(toDelEntries, e)
 		}
 	}
-
+	if guard != nil && !guard.Allow(version, len(current), len(toDelEntries), noPeers) {
+		for _, e := range toDelEntries {
+			desired[e] = true
+		}
+		toDelEntries = nil
+	}
 	return toAddEntries, toDelEntries
 }
 
-func (w *watcher) getCurrentIPSetEntries() (map[string]bool, error) {
+func (w *watcher) getCurrentIPSetEntries(name string) (map[string]bool, error) {
 	currentEntries := map[string]bool{}
-	out, err := exec.Command(w.ipsetPath, "list", "-o", "xml", w.ipsetName).CombinedOutput()
-	if err != nil {
-		return currentEntries, errors.Wrapf(err, "Failed to list ipset %s: %s", w.ipsetName, out)
-	}
-	o, err := unmarshalIPSetByXML(out)
+	entries, err := w.ipsets.List(name)
 	if err != nil {
 		return currentEntries, err
 	}
-	for _, e := range o.Members {
+	for _, e := range entries {
 		currentEntries[e] = true
 	}
 	return currentEntries, nil
 }
 
-func (w *watcher) getDesiredIPSetEntries(selfHost metadata.Host, allHosts []metadata.Host) map[string]bool {
+// getDesiredIPSetEntries returns the peer subnets along with the configured
+// extra subnets and those listed by the networks metadata, and whether
+// metadata listed no peer at all, drained and unselected ones included.
+func (w *watcher) getDesiredIPSetEntries(s *reconcile.Snapshot) (map[string]bool, bool) {
 	desiredEntries := map[string]bool{}
-	for _, h := range allHosts {
-		if h.UUID != selfHost.UUID {
-			subnet := h.Labels[perHostSubnetLabel]
-			desiredEntries[subnet] = true
+	for _, h := range s.Hosts {
+		if h.UUID == s.SelfHost.UUID {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(h.Labels[setting.SubnetLabel])
+		if err != nil {
+			logrus.Warnf("Failed to parse host %s subnet, skipping it: %v", h.Name, err)
+			continue
+		}
+		desiredEntries[subnet.String()] = true
+	}
+	// Validated when the config is loaded.
+	for _, cidr := range setting.NATExemptCIDRs {
+		_, subnet, _ := net.ParseCIDR(cidr)
+		desiredEntries[subnet.String()] = true
+	}
+	for _, n := range s.Networks {
+		for _, cidr := range metadataCIDRs(n.Metadata[setting.NATExemptKey]) {
+			_, subnet, err := net.ParseCIDR(cidr)
+			if err != nil || subnet.IP.To4() == nil {
+				logrus.Warnf("Invalid NAT exempt subnet %q in network %s metadata, skipping it", cidr, n.Name)
+				continue
+			}
+			desiredEntries[subnet.String()] = true
+		}
+	}
+	return desiredEntries, s.AllPeers == 0
+}
+
+// metadataCIDRs accepts a list or a comma separated string.
+func metadataCIDRs(v interface{}) []string {
+	var rtn []string
+	switch v := v.(type) {
+	case string:
+		for _, cidr := range strings.Split(v, ",") {
+			if cidr = strings.TrimSpace(cidr); cidr != "" {
+				rtn = append(rtn, cidr)
+			}
+		}
+	case []interface{}:
+		for _, cidr := range v {
+			rtn = append(rtn, fmt.Sprint(cidr))
 		}
 	}
-	return desiredEntries
+	return rtn
 }
@@ -2,6 +2,8 @@
 
 package hostnat
 
-import "github.com/rancher/go-rancher-metadata/metadata"
+import "github.com/rancher/per-host-subnet/reconcile"
 
-func Watch(c metadata.Client) error { return nil }
+func Watch(r *reconcile.Reconciler, natBackend, ipsetBackend string, flushConntrack bool) error {
+	return nil
+}
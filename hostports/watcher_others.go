@@ -2,6 +2,6 @@
 
 package hostports
 
-import "github.com/rancher/go-rancher-metadata/metadata"
+import "github.com/rancher/per-host-subnet/reconcile"
 
-func Watch(c metadata.Client) error { return nil }
+func Watch(r *reconcile.Reconciler) error { return nil }
@@ -5,7 +5,6 @@ import (
 	"net"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/pkg/errors"
 
@@ -14,12 +13,16 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/rancher/go-rancher-metadata/metadata"
 	natdrivers "github.com/rancher/go-winnat/drivers"
+	"github.com/rancher/per-host-subnet/reconcile"
+	"github.com/rancher/per-host-subnet/setting"
+	"github.com/rancher/per-host-subnet/state"
 )
 
 const (
-	reapplyEvery  = 5 * time.Minute
-	networkName   = "transparent"
-	routerIPLabel = "io.rancher.network.per_host_subnet.router_ip"
+	applyOp   = "apply"
+	applyItem = "port mappings"
+
+	portMappingKind = "port mapping"
 )
 
 var (
@@ -27,14 +30,34 @@ var (
 )
 
 type watcher struct {
-	c                metadata.Client
 	natdriver        winnat.NatDriver
 	appliedPortRules map[string]natdrivers.PortMapping
-	lastApplied      time.Time
+	retries          *reconcile.RetryQueue
+	owner            *state.Owner
+}
+
+func Watch(r *reconcile.Reconciler) error {
+	w := &watcher{
+		appliedPortRules: map[string]natdrivers.PortMapping{},
+		retries:          r.NewRetryQueue(),
+		owner:            r.Owner("hostports"),
+	}
+	r.Register(w)
+	return nil
 }
 
-func Watch(c metadata.Client) error {
-	names, err := getNatInterfaceNames(c)
+func (w *watcher) Name() string {
+	return "hostports"
+}
+
+func (w *watcher) Retries() *reconcile.RetryQueue {
+	return w.retries
+}
+
+// initDriver creates the NAT driver on the first snapshot, since the NAT
+// interfaces depend on the self host labels.
+func (w *watcher) initDriver(selfHost metadata.Host) error {
+	names, err := getNatInterfaceNames(selfHost)
 	if err != nil {
 		return err
 	}
@@ -48,48 +71,50 @@ func Watch(c metadata.Client) error {
 	if err != nil {
 		return err
 	}
-	w := &watcher{
-		c:                c,
-		natdriver:        driver,
-		appliedPortRules: map[string]natdrivers.PortMapping{},
-	}
-	go c.OnChange(5, w.onChangeNoError)
+	w.natdriver = driver
 	return nil
 }
 
-func (w *watcher) onChangeNoError(version string) {
-	if err := w.onChange(version); err != nil {
-		logrus.Errorf("Failed to apply ipset: %v", err)
-	}
-}
-
-func (w *watcher) onChange(version string) error {
-	logrus.Debug("hostports:  Creating rule set")
-	newPortRules := map[string]natdrivers.PortMapping{}
-
-	host, err := w.c.GetSelfHost()
+func (w *watcher) Reconcile(s *reconcile.Snapshot) error {
+	newPortRules, err := w.getPortRules(s)
 	if err != nil {
 		return err
 	}
+	defer w.retries.Prune()
+	if !compareRules(w.appliedPortRules, newPortRules) && w.retries.Ready(applyOp, applyItem) {
+		logrus.Infof("hostports: : Applying new rules")
+		return w.apply(newPortRules)
+	}
+	return nil
+}
 
-	networks, err := w.c.GetNetworks()
+func (w *watcher) Resync(s *reconcile.Snapshot) error {
+	newPortRules, err := w.getPortRules(s)
 	if err != nil {
 		return err
 	}
+	return w.apply(newPortRules)
+}
 
-	networkUUID, err := networkUUID(networks)
-	if err != nil {
-		return err
+func (w *watcher) getPortRules(s *reconcile.Snapshot) (map[string]natdrivers.PortMapping, error) {
+	logrus.Debug("hostports:  Creating rule set")
+	newPortRules := map[string]natdrivers.PortMapping{}
+
+	if w.natdriver == nil {
+		if err := w.initDriver(s.SelfHost); err != nil {
+			return nil, err
+		}
 	}
+	host := s.SelfHost
 
-	containers, err := w.c.GetContainers()
+	networkUUID, err := networkUUID(s.Networks)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	//Find containers assigned to this host and use per-host-subnet
 	//And generate the port mapping rules
-	for _, container := range containers {
+	for _, container := range s.Containers {
 		if container.HostUUID != host.UUID || container.NetworkUUID != networkUUID {
 			continue
 		}
@@ -108,38 +133,77 @@ func (w *watcher) onChange(version string) error {
 		}
 	}
 	logrus.Debugf("hostports:  New generated rules: %v", newPortRules)
-	if !compareRules(w.appliedPortRules, newPortRules) {
-		logrus.Infof("hostports: : Applying new rules")
-		return w.apply(newPortRules)
-	} else if time.Now().Sub(w.lastApplied) > reapplyEvery {
-		return w.apply(newPortRules)
-	}
-	return nil
+	return newPortRules, nil
 }
 
+// apply replaces every port mapping, a failure leaves appliedPortRules alone
+// so the next attempt, spaced by the retry queue, reapplies them.
 func (w *watcher) apply(newRules map[string]natdrivers.PortMapping) error {
-	defer func() {
+	var e reconcile.MultiError
+	err := w.replacePortMappings(newRules)
+	w.retries.Done(applyOp, applyItem, err)
+	e.Add(applyOp, applyItem, err)
+	if err == nil {
 		w.appliedPortRules = newRules
-		w.lastApplied = time.Now()
-	}()
+	}
+	return e.ErrorOrNil()
+}
+
+// replacePortMappings deletes the mappings created by the agent, and the
+// ones in the way of the new rules, before creating the new rules. Until the
+// state store knows about port mappings every existing one is deleted, as
+// they may have been created before it existed.
+func (w *watcher) replacePortMappings(newRules map[string]natdrivers.PortMapping) error {
 	l, err := w.natdriver.ListPortMapping()
 	if err != nil {
 		return err
 	}
 	logrus.Infof("%#v", l)
 	var rules []natdrivers.PortMapping
+	wanted := map[string]bool{}
 	for _, rule := range newRules {
 		rules = append(rules, rule)
+		wanted[portMappingKey(&rule)] = true
+	}
+
+	known := w.owner.Known()
+	var stale []natdrivers.PortMapping
+	for i := range l {
+		key := portMappingKey(&l[i])
+		if !known || wanted[key] || w.owner.Has(portMappingKind, key) {
+			stale = append(stale, l[i])
+		}
 	}
-	if err := w.natdriver.DeletePortMappings(l); err != nil {
+	if err := w.natdriver.DeletePortMappings(stale); err != nil {
 		return errors.Wrap(err, "error when deleting current port mapping rules")
 	}
-	return w.natdriver.CreatePortMappings(rules)
+	if err := w.owner.Init(); err != nil {
+		return err
+	}
+	for _, key := range w.owner.Keys(portMappingKind) {
+		if err := w.owner.Remove(portMappingKind, key); err != nil {
+			return err
+		}
+	}
+
+	if err := w.natdriver.CreatePortMappings(rules); err != nil {
+		return err
+	}
+	for i := range rules {
+		if err := w.owner.Add(portMappingKind, portMappingKey(&rules[i]), rules[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func portMappingKey(m *natdrivers.PortMapping) string {
+	return strings.ToLower(m.Protocol) + " " + m.ExternalIP.String() + ":" + strconv.Itoa(int(m.ExternalPort))
 }
 
 func networkUUID(networks []metadata.Network) (string, error) {
 	for _, network := range networks {
-		if network.Name == networkName {
+		if network.Name == setting.HostPortsNetwork {
 			return network.UUID, nil
 		}
 	}
@@ -195,14 +259,10 @@ func compareRules(a, b map[string]natdrivers.PortMapping) bool {
 	return true
 }
 
-func getNatInterfaceNames(c metadata.Client) ([]string, error) {
-	selfHost, err := c.GetSelfHost()
-	if err != nil {
-		return nil, err
-	}
-	routerip, ok := selfHost.Labels[routerIPLabel]
+func getNatInterfaceNames(selfHost metadata.Host) ([]string, error) {
+	routerip, ok := selfHost.Labels[setting.RouterIPLabel]
 	if !ok {
-		return nil, fmt.Errorf("Missing rancher labels %s", routerIPLabel)
+		return nil, fmt.Errorf("Missing rancher labels %s", setting.RouterIPLabel)
 	}
 	var rtn []string
 	is, err := net.Interfaces()
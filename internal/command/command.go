@@ -0,0 +1,18 @@
+// Package command holds what the wrappers around iptables, ipset and nft
+// share.
+package command
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Error adds the output of a failed command to its error, nil when the
+// command succeeded.
+func Error(err error, out []byte) error {
+	if err == nil {
+		return nil
+	}
+	return errors.Errorf("%v: %s", err, strings.TrimSpace(string(out)))
+}
@@ -0,0 +1,35 @@
+// Package nfnetlink holds the message header and attribute helpers shared by
+// the nfnetlink clients, ipset and conntrack.
+package nfnetlink
+
+import (
+	"encoding/binary"
+)
+
+// From linux/netlink.h.
+const (
+	NlaFNested       = 0x8000
+	NlaFNetByteorder = 0x4000
+	NlaTypeMask      = ^uint16(NlaFNested | NlaFNetByteorder)
+
+	NlmFDump = 0x300
+)
+
+const SizeofNfgenmsg = 4
+
+// Nfgenmsg is the header following the netlink one in nfnetlink messages.
+type Nfgenmsg struct {
+	Family uint8
+	ResID  uint16
+}
+
+func (m *Nfgenmsg) Len() int {
+	return SizeofNfgenmsg
+}
+
+func (m *Nfgenmsg) Serialize() []byte {
+	b := make([]byte, SizeofNfgenmsg)
+	b[0] = m.Family
+	binary.BigEndian.PutUint16(b[2:], m.ResID)
+	return b
+}
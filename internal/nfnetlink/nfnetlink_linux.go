@@ -0,0 +1,29 @@
+package nfnetlink
+
+import (
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// NewRequest returns a request for cmd of subsys, with its nfgenmsg header.
+func NewRequest(subsys, cmd, flags int, family uint8) *nl.NetlinkRequest {
+	req := nl.NewNetlinkRequest(subsys<<8|cmd, flags)
+	req.AddData(&Nfgenmsg{Family: family})
+	return req
+}
+
+// ParseAttrs returns the top level attributes of a message stripped of its
+// netlink header, as answered by Execute.
+func ParseAttrs(m []byte) ([]syscall.NetlinkRouteAttr, error) {
+	if len(m) < SizeofNfgenmsg {
+		return nil, errors.New("message too short")
+	}
+	return nl.ParseRouteAttr(m[SizeofNfgenmsg:])
+}
+
+// AttrType is the type of a, without the nested and byte order flags.
+func AttrType(a syscall.NetlinkRouteAttr) uint16 {
+	return a.Attr.Type & NlaTypeMask
+}
@@ -0,0 +1,136 @@
+package ipset
+
+import (
+	"bytes"
+	"encoding/xml"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/per-host-subnet/internal/command"
+)
+
+var restoreErrorRe = regexp.MustCompile(`Error in line (\d+): (.*)`)
+
+type execBackend struct {
+	path string
+}
+
+func newExec() (Interface, error) {
+	path, err := exec.LookPath("ipset")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to lookup ipset")
+	}
+	return &execBackend{path: path}, nil
+}
+
+func (e *execBackend) Name() string {
+	return BackendExec
+}
+
+func (e *execBackend) Create(name, setType string) error {
+	return e.run("create", "--exist", name, setType)
+}
+
+func (e *execBackend) Destroy(name string) error {
+	out, err := exec.Command(e.path, "destroy", name).CombinedOutput()
+	if err != nil && !strings.Contains(string(out), "does not exist") {
+		return command.Error(err, out)
+	}
+	return nil
+}
+
+func (e *execBackend) List(name string) ([]string, error) {
+	out, err := exec.Command(e.path, "list", "-o", "xml", name).CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrapf(command.Error(err, out), "Failed to list ipset %s", name)
+	}
+	o, err := unmarshalIPSetByXML(out)
+	if err != nil {
+		return nil, err
+	}
+	var entries []string
+	for _, m := range o.members() {
+		n, err := normalize(m)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, n.String())
+	}
+	return entries, nil
+}
+
+func (e *execBackend) Add(name, entry string) error {
+	return e.run("add", name, entry, "-exist")
+}
+
+func (e *execBackend) Del(name, entry string) error {
+	return e.run("del", name, entry, "-exist")
+}
+
+func (e *execBackend) Swap(name, otherName string) error {
+	return e.run("swap", name, otherName)
+}
+
+// Apply feeds ops to ipset restore. Restore stops at the first failing line,
+// the lines after it are then fed again.
+func (e *execBackend) Apply(ops []Op) []error {
+	errs := make([]error, len(ops))
+	for start := 0; start < len(ops); {
+		var script bytes.Buffer
+		for _, op := range ops[start:] {
+			script.WriteString(op.String())
+			script.WriteString("\n")
+		}
+		cmd := exec.Command(e.path, "-exist", "restore")
+		cmd.Stdin = &script
+		out, err := cmd.CombinedOutput()
+		if err == nil {
+			break
+		}
+		line := 0
+		m := restoreErrorRe.FindStringSubmatch(string(out))
+		if m != nil {
+			line, _ = strconv.Atoi(m[1])
+		}
+		if line < 1 || start+line > len(ops) {
+			// Not a line error, fail every op that may not have run.
+			for i := start; i < len(ops); i++ {
+				errs[i] = command.Error(err, out)
+			}
+			break
+		}
+		errs[start+line-1] = errors.New(strings.TrimSpace(m[2]))
+		start += line
+	}
+	return errs
+}
+
+func (e *execBackend) run(args ...string) error {
+	out, err := exec.Command(e.path, args...).CombinedOutput()
+	return command.Error(err, out)
+}
+
+// ipsets holds the members as listed by ipset 6.20 and older, as plain elem,
+// and by later versions, wrapped in a member along with their options.
+type ipsets struct {
+	XMLName    xml.Name `xml:"ipsets"`
+	Elems      []string `xml:"ipset>members>elem"`
+	MemberElem []string `xml:"ipset>members>member>elem"`
+}
+
+func (o ipsets) members() []string {
+	return append(o.Elems, o.MemberElem...)
+}
+
+func unmarshalIPSetByXML(data []byte) (ipsets, error) {
+	o := ipsets{}
+	err := xml.Unmarshal(data, &o)
+	if err != nil {
+		return o, errors.Wrap(err, "Failed to Unmarshal xml")
+	}
+
+	return o, nil
+}
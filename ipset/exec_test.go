@@ -0,0 +1,91 @@
+//+build !windows
+
+package ipset
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeRestore fails the way ipset restore does, with the messages of ipset
+// v6.34: at the first line adding 10.0.0.0/33 with a line error, at the first
+// line creating a set with a kernel error.
+const fakeRestore = `#!/bin/sh
+n=0
+while read -r line; do
+	n=$((n+1))
+	case "$line" in
+	*10.0.0.0/33*)
+		echo "ipset v6.34: Error in line $n: Syntax error: '33' is out of range 0-32" >&2
+		exit 1;;
+	create*)
+		echo "ipset v6.34: Kernel error received: Operation not permitted" >&2
+		exit 1;;
+	esac
+done
+`
+
+func TestExecApply(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipset")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ipset")
+	if err := ioutil.WriteFile(path, []byte(fakeRestore), 0755); err != nil {
+		t.Fatal(err)
+	}
+	e := &execBackend{path: path}
+
+	add := func(entry string) Op {
+		return Op{Cmd: OpAdd, Set: "s", Arg: entry}
+	}
+	const lineError = "Syntax error: '33' is out of range 0-32"
+	tests := []struct {
+		name string
+		ops  []Op
+		// want is the error of every op, "" when it succeeds and
+		// "*" for the command error.
+		want []string
+	}{
+		{
+			name: "success",
+			ops:  []Op{add("10.0.0.0/8"), add("10.1.0.0/16")},
+			want: []string{"", ""},
+		},
+		{
+			name: "failed line",
+			ops:  []Op{add("10.0.0.0/8"), add("10.0.0.0/33"), add("10.1.0.0/16")},
+			want: []string{"", lineError, ""},
+		},
+		{
+			name: "several failed lines",
+			ops:  []Op{add("10.0.0.0/33"), add("10.0.0.0/8"), add("10.0.0.0/33"), add("10.0.0.0/33")},
+			want: []string{lineError, "", lineError, lineError},
+		},
+		{
+			name: "not a line error",
+			ops:  []Op{add("10.0.0.0/33"), add("10.0.0.0/8"), {Cmd: OpCreate, Set: "s", Arg: TypeHashNet}, add("10.1.0.0/16")},
+			want: []string{lineError, "*", "*", "*"},
+		},
+	}
+	for _, tt := range tests {
+		errs := e.Apply(tt.ops)
+		if len(errs) != len(tt.ops) {
+			t.Errorf("%s: got %d errors for %d ops", tt.name, len(errs), len(tt.ops))
+			continue
+		}
+		for i, err := range errs {
+			switch want := tt.want[i]; {
+			case want == "" && err != nil:
+				t.Errorf("%s: op %d: unexpected error %v", tt.name, i, err)
+			case want == "*" && (err == nil || err.Error() != "exit status 1: ipset v6.34: Kernel error received: Operation not permitted"):
+				t.Errorf("%s: op %d: got error %v, want the command error", tt.name, i, err)
+			case want != "" && want != "*" && (err == nil || err.Error() != want):
+				t.Errorf("%s: op %d: got error %v, want %q", tt.name, i, err, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+// Package ipset manages ipsets of type hash:net, either over the netfilter
+// netlink protocol or through the ipset binary.
+package ipset
+
+import (
+	"net"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+const (
+	BackendAuto    = "auto"
+	BackendNetlink = "netlink"
+	BackendExec    = "exec"
+
+	TypeHashNet = "hash:net"
+
+	// MaxNameLen is the longest set name, one less than IPSET_MAXNAMELEN.
+	MaxNameLen = 31
+)
+
+// Interface is implemented by every backend. Entries are IPv4 subnets in
+// CIDR notation. Creating an existing set of the same type, adding an
+// existing entry, deleting a missing entry or destroying a missing set
+// succeed.
+type Interface interface {
+	Name() string
+	Create(name, setType string) error
+	Destroy(name string) error
+	List(name string) ([]string, error)
+	Add(name, entry string) error
+	Del(name, entry string) error
+	// Swap exchanges the content of two sets of the same type.
+	Swap(name, otherName string) error
+	// Apply runs ops in order in one go, going on past a failed op, and
+	// returns the error of every op, nil when it succeeded.
+	Apply(ops []Op) []error
+}
+
+const (
+	OpCreate  = "create"
+	OpFlush   = "flush"
+	OpAdd     = "add"
+	OpDel     = "del"
+	OpSwap    = "swap"
+	OpDestroy = "destroy"
+)
+
+// Op is a single command of a batch, Arg is the set type of OpCreate, the
+// entry of OpAdd and OpDel and the other set of OpSwap.
+type Op struct {
+	Cmd string
+	Set string
+	Arg string
+}
+
+// String returns the op as a line of an ipset restore script.
+func (o Op) String() string {
+	if o.Arg == "" {
+		return o.Cmd + " " + o.Set
+	}
+	return o.Cmd + " " + o.Set + " " + o.Arg
+}
+
+// New returns the backend named backend, auto picks netlink when the
+// kernel answers over it and falls back to the ipset binary.
+func New(backend string) (Interface, error) {
+	switch backend {
+	case BackendNetlink:
+		return newNetlink()
+	case BackendExec:
+		return newExec()
+	case BackendAuto:
+		n, err := newNetlink()
+		if err == nil {
+			return n, nil
+		}
+		logrus.Infof("ipset: netlink unavailable, falling back to the ipset binary: %v", err)
+		return newExec()
+	}
+	return nil, errors.Errorf("Unknown ipset backend %q, expected %s, %s or %s", backend, BackendAuto, BackendNetlink, BackendExec)
+}
+
+// normalize turns an entry into the CIDR notation, a plain IP being a /32.
+func normalize(entry string) (*net.IPNet, error) {
+	if !strings.Contains(entry, "/") {
+		entry += "/32"
+	}
+	_, n, err := net.ParseCIDR(entry)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid ipset entry %q", entry)
+	}
+	if n.IP.To4() == nil {
+		return nil, errors.Errorf("Invalid ipset entry %q: only IPv4 is supported", entry)
+	}
+	return n, nil
+}
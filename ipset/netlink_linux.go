@@ -0,0 +1,304 @@
+package ipset
+
+import (
+	"net"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/per-host-subnet/internal/nfnetlink"
+	"github.com/vishvananda/netlink/nl"
+	"github.com/vishvananda/netns"
+)
+
+// From linux/netfilter/nfnetlink.h and linux/netfilter/ipset/ip_set.h.
+const (
+	nfnlSubsysIPSet = 6
+	nfprotoIPv4     = 2
+
+	protocol = 6
+
+	cmdProtocol = 1
+	cmdCreate   = 2
+	cmdDestroy  = 3
+	cmdFlush    = 4
+	cmdSwap     = 6
+	cmdList     = 7
+	cmdAdd      = 9
+	cmdDel      = 10
+	cmdType     = 13
+
+	attrProtocol = 1
+	attrSetName  = 2
+	attrTypeName = 3
+	attrSetName2 = 3
+	attrRevision = 4
+	attrFamily   = 5
+	attrData     = 7
+	attrADT      = 8
+
+	attrIP         = 1
+	attrCIDR       = 3
+	attrIPAddrIPv4 = 1
+
+	errFirst = 4096
+)
+
+// ipsetErrors are the ipset specific error codes the kernel may answer.
+var ipsetErrors = map[syscall.Errno]string{
+	errFirst + 1:  "kernel and agent ipset protocols are incompatible",
+	errFirst + 2:  "set type not supported by the kernel",
+	errFirst + 3:  "kernel set limit reached",
+	errFirst + 4:  "set is in use by the kernel",
+	errFirst + 5:  "second set does not exist",
+	errFirst + 6:  "sets have different types",
+	errFirst + 7:  "set already exists with another type",
+	errFirst + 8:  "invalid CIDR",
+	errFirst + 9:  "invalid netmask",
+	errFirst + 10: "invalid family",
+	errFirst + 11: "timeout not supported",
+	errFirst + 12: "set already exists",
+	errFirst + 13: "referenced set can't be renamed or swapped",
+	errFirst + 14: "set type has no ipv6 support",
+	errFirst + 15: "counters not supported",
+	errFirst + 16: "comments not supported",
+	errFirst + 17: "invalid MAC address",
+	errFirst + 18: "skbinfo not supported",
+}
+
+type netlinkBackend struct {
+	// sockets is the socket shared by the requests of a batch.
+	sockets map[int]*nl.SocketHandle
+}
+
+// newNetlink checks the kernel speaks the ipset protocol of the agent, it
+// answers an error otherwise.
+func newNetlink() (Interface, error) {
+	n := &netlinkBackend{}
+	if _, err := n.execute(cmdProtocol, 0, nil); err != nil {
+		return nil, errors.Wrap(err, "Failed to get the kernel ipset protocol")
+	}
+	return n, nil
+}
+
+func (n *netlinkBackend) Name() string {
+	return BackendNetlink
+}
+
+func (n *netlinkBackend) Create(name, setType string) error {
+	revision, err := n.revision(setType)
+	if err != nil {
+		return err
+	}
+	_, err = n.execute(cmdCreate, syscall.NLM_F_ACK, []*nl.RtAttr{
+		nl.NewRtAttr(attrSetName, nl.ZeroTerminated(name)),
+		nl.NewRtAttr(attrTypeName, nl.ZeroTerminated(setType)),
+		nl.NewRtAttr(attrRevision, nl.Uint8Attr(revision)),
+		nl.NewRtAttr(attrFamily, nl.Uint8Attr(nfprotoIPv4)),
+		nl.NewRtAttr(attrData|nfnetlink.NlaFNested, nil),
+	})
+	return errors.Wrapf(err, "Failed to create ipset %s", name)
+}
+
+// revision returns the latest revision of setType the kernel supports.
+func (n *netlinkBackend) revision(setType string) (uint8, error) {
+	msgs, err := n.execute(cmdType, 0, []*nl.RtAttr{
+		nl.NewRtAttr(attrTypeName, nl.ZeroTerminated(setType)),
+		nl.NewRtAttr(attrFamily, nl.Uint8Attr(nfprotoIPv4)),
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "Failed to get the kernel revision of ipset type %s", setType)
+	}
+	for _, a := range attrs(msgs) {
+		if nfnetlink.AttrType(a) == attrRevision && len(a.Value) > 0 {
+			return a.Value[0], nil
+		}
+	}
+	return 0, errors.Errorf("Kernel didn't return the revision of ipset type %s", setType)
+}
+
+func (n *netlinkBackend) Destroy(name string) error {
+	_, err := n.execute(cmdDestroy, syscall.NLM_F_ACK, []*nl.RtAttr{
+		nl.NewRtAttr(attrSetName, nl.ZeroTerminated(name)),
+	})
+	if err == syscall.ENOENT {
+		return nil
+	}
+	return errors.Wrapf(err, "Failed to destroy ipset %s", name)
+}
+
+func (n *netlinkBackend) List(name string) ([]string, error) {
+	msgs, err := n.execute(cmdList, nfnetlink.NlmFDump, []*nl.RtAttr{
+		nl.NewRtAttr(attrSetName, nl.ZeroTerminated(name)),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to list ipset %s", name)
+	}
+	entries, err := parseEntries(msgs)
+	return entries, errors.Wrapf(err, "Failed to parse ipset %s entries", name)
+}
+
+func (n *netlinkBackend) Add(name, entry string) error {
+	return n.adt(cmdAdd, name, entry)
+}
+
+func (n *netlinkBackend) Del(name, entry string) error {
+	return n.adt(cmdDel, name, entry)
+}
+
+// adt adds or deletes an entry. Without NLM_F_EXCL the kernel ignores
+// existing and missing entries.
+func (n *netlinkBackend) adt(cmd int, name, entry string) error {
+	ipNet, err := normalize(entry)
+	if err != nil {
+		return err
+	}
+	ones, _ := ipNet.Mask.Size()
+	data := nl.NewRtAttr(attrData|nfnetlink.NlaFNested, nil)
+	ip := nl.NewRtAttrChild(data, attrIP|nfnetlink.NlaFNested, nil)
+	nl.NewRtAttrChild(ip, attrIPAddrIPv4|nfnetlink.NlaFNetByteorder, []byte(ipNet.IP.To4()))
+	nl.NewRtAttrChild(data, attrCIDR, nl.Uint8Attr(uint8(ones)))
+	_, err = n.execute(cmd, syscall.NLM_F_ACK, []*nl.RtAttr{
+		nl.NewRtAttr(attrSetName, nl.ZeroTerminated(name)),
+		data,
+	})
+	return err
+}
+
+func (n *netlinkBackend) flush(name string) error {
+	_, err := n.execute(cmdFlush, syscall.NLM_F_ACK, []*nl.RtAttr{
+		nl.NewRtAttr(attrSetName, nl.ZeroTerminated(name)),
+	})
+	return errors.Wrapf(err, "Failed to flush ipset %s", name)
+}
+
+// Apply runs ops over a single netlink socket.
+func (n *netlinkBackend) Apply(ops []Op) []error {
+	errs := make([]error, len(ops))
+	s, err := nl.GetNetlinkSocketAt(netns.None(), netns.None(), syscall.NETLINK_NETFILTER)
+	if err != nil {
+		for i := range errs {
+			errs[i] = errors.Wrap(err, "Failed to open netlink socket")
+		}
+		return errs
+	}
+	defer s.Close()
+	n.sockets = map[int]*nl.SocketHandle{
+		syscall.NETLINK_NETFILTER: {Socket: s},
+	}
+	defer func() {
+		n.sockets = nil
+	}()
+
+	for i, op := range ops {
+		switch op.Cmd {
+		case OpCreate:
+			errs[i] = n.Create(op.Set, op.Arg)
+		case OpFlush:
+			errs[i] = n.flush(op.Set)
+		case OpAdd:
+			errs[i] = n.Add(op.Set, op.Arg)
+		case OpDel:
+			errs[i] = n.Del(op.Set, op.Arg)
+		case OpSwap:
+			errs[i] = n.Swap(op.Set, op.Arg)
+		case OpDestroy:
+			errs[i] = n.Destroy(op.Set)
+		default:
+			errs[i] = errors.Errorf("Unknown ipset op %s", op.Cmd)
+		}
+	}
+	return errs
+}
+
+func (n *netlinkBackend) Swap(name, otherName string) error {
+	_, err := n.execute(cmdSwap, syscall.NLM_F_ACK, []*nl.RtAttr{
+		nl.NewRtAttr(attrSetName, nl.ZeroTerminated(name)),
+		nl.NewRtAttr(attrSetName2, nl.ZeroTerminated(otherName)),
+	})
+	return errors.Wrapf(err, "Failed to swap ipsets %s and %s", name, otherName)
+}
+
+// execute sends cmd with the protocol attribute followed by attrs and returns
+// the answers, without their netlink header.
+func (n *netlinkBackend) execute(cmd, flags int, attrs []*nl.RtAttr) ([][]byte, error) {
+	req := nfnetlink.NewRequest(nfnlSubsysIPSet, cmd, flags, nfprotoIPv4)
+	req.Sockets = n.sockets
+	req.AddData(nl.NewRtAttr(attrProtocol, nl.Uint8Attr(protocol)))
+	for _, a := range attrs {
+		req.AddData(a)
+	}
+	msgs, err := req.Execute(syscall.NETLINK_NETFILTER, 0)
+	if errno, ok := err.(syscall.Errno); ok {
+		if msg, ok := ipsetErrors[errno]; ok {
+			return nil, errors.New(msg)
+		}
+	}
+	return msgs, err
+}
+
+// attrs returns the top level attributes of the answers.
+func attrs(msgs [][]byte) []syscall.NetlinkRouteAttr {
+	var rtn []syscall.NetlinkRouteAttr
+	for _, m := range msgs {
+		a, err := nfnetlink.ParseAttrs(m)
+		if err != nil {
+			continue
+		}
+		rtn = append(rtn, a...)
+	}
+	return rtn
+}
+
+// parseEntries reads the entries of the IPSET_ATTR_ADT of list answers.
+func parseEntries(msgs [][]byte) ([]string, error) {
+	var entries []string
+	for _, a := range attrs(msgs) {
+		if nfnetlink.AttrType(a) != attrADT {
+			continue
+		}
+		data, err := nl.ParseRouteAttr(a.Value)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range data {
+			entry, err := parseEntry(d.Value)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// parseEntry reads an IPSET_ATTR_DATA of a hash:net set.
+func parseEntry(b []byte) (string, error) {
+	data, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return "", err
+	}
+	var ip net.IP
+	ones := 32
+	for _, d := range data {
+		switch nfnetlink.AttrType(d) {
+		case attrIP:
+			addrs, err := nl.ParseRouteAttr(d.Value)
+			if err != nil {
+				return "", err
+			}
+			for _, a := range addrs {
+				if nfnetlink.AttrType(a) == attrIPAddrIPv4 && len(a.Value) == net.IPv4len {
+					ip = net.IP(a.Value)
+				}
+			}
+		case attrCIDR:
+			if len(d.Value) > 0 {
+				ones = int(d.Value[0])
+			}
+		}
+	}
+	if ip == nil {
+		return "", errors.New("entry without IPv4 address")
+	}
+	return (&net.IPNet{IP: ip, Mask: net.CIDRMask(ones, 32)}).String(), nil
+}
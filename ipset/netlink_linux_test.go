@@ -0,0 +1,154 @@
+package ipset
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/rancher/per-host-subnet/internal/nfnetlink"
+	"github.com/vishvananda/netlink/nl"
+)
+
+// Answers to IPSET_CMD_LIST captured from a 6.18 kernel, without their
+// netlink header.
+var (
+	// hash:net with 192.168.0.0/16, 10.42.2.0/24 and 10.42.0.0/16.
+	listNets = []byte{
+		0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00, 0x00,
+		0x23, 0x00, 0x02, 0x00, 0x52, 0x41, 0x4e, 0x43, 0x48, 0x45, 0x52, 0x5f,
+		0x44, 0x49, 0x53, 0x41, 0x42, 0x4c, 0x45, 0x5f, 0x48, 0x4f, 0x53, 0x54,
+		0x5f, 0x4e, 0x41, 0x54, 0x5f, 0x49, 0x50, 0x53, 0x45, 0x54, 0x00, 0x00,
+		0x0d, 0x00, 0x03, 0x00, 0x68, 0x61, 0x73, 0x68, 0x3a, 0x6e, 0x65, 0x74,
+		0x00, 0x00, 0x00, 0x00, 0x05, 0x00, 0x05, 0x00, 0x02, 0x00, 0x00, 0x00,
+		0x05, 0x00, 0x04, 0x00, 0x07, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x07, 0x80,
+		0x08, 0x00, 0x12, 0x40, 0x00, 0x00, 0x04, 0x00, 0x08, 0x00, 0x13, 0x40,
+		0x00, 0x01, 0x00, 0x00, 0x05, 0x00, 0x15, 0x00, 0x0c, 0x00, 0x00, 0x00,
+		0x08, 0x00, 0x11, 0x40, 0xc7, 0x36, 0x4f, 0x42, 0x08, 0x00, 0x19, 0x40,
+		0x00, 0x00, 0x00, 0x00, 0x08, 0x00, 0x1a, 0x40, 0x00, 0x00, 0x02, 0x58,
+		0x08, 0x00, 0x18, 0x40, 0x00, 0x00, 0x00, 0x03, 0x4c, 0x00, 0x08, 0x80,
+		0x18, 0x00, 0x07, 0x80, 0x0c, 0x00, 0x01, 0x80, 0x08, 0x00, 0x01, 0x00,
+		0xc0, 0xa8, 0x00, 0x00, 0x05, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x00,
+		0x18, 0x00, 0x07, 0x80, 0x0c, 0x00, 0x01, 0x80, 0x08, 0x00, 0x01, 0x00,
+		0x0a, 0x2a, 0x02, 0x00, 0x05, 0x00, 0x03, 0x00, 0x18, 0x00, 0x00, 0x00,
+		0x18, 0x00, 0x07, 0x80, 0x0c, 0x00, 0x01, 0x80, 0x08, 0x00, 0x01, 0x00,
+		0x0a, 0x2a, 0x00, 0x00, 0x05, 0x00, 0x03, 0x00, 0x10, 0x00, 0x00, 0x00,
+	}
+	// hash:net with 10.42.1.5/32 and 10.42.1.7/32.
+	listHosts = []byte{
+		0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x01, 0x00, 0x06, 0x00, 0x00, 0x00,
+		0x20, 0x00, 0x02, 0x00, 0x52, 0x41, 0x4e, 0x43, 0x48, 0x45, 0x52, 0x5f,
+		0x4e, 0x4f, 0x5f, 0x4d, 0x41, 0x53, 0x51, 0x55, 0x45, 0x52, 0x41, 0x44,
+		0x45, 0x5f, 0x49, 0x50, 0x53, 0x45, 0x54, 0x00, 0x0d, 0x00, 0x03, 0x00,
+		0x68, 0x61, 0x73, 0x68, 0x3a, 0x6e, 0x65, 0x74, 0x00, 0x00, 0x00, 0x00,
+		0x05, 0x00, 0x05, 0x00, 0x02, 0x00, 0x00, 0x00, 0x05, 0x00, 0x04, 0x00,
+		0x07, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x07, 0x80, 0x08, 0x00, 0x12, 0x40,
+		0x00, 0x00, 0x04, 0x00, 0x08, 0x00, 0x13, 0x40, 0x00, 0x01, 0x00, 0x00,
+		0x05, 0x00, 0x15, 0x00, 0x0c, 0x00, 0x00, 0x00, 0x08, 0x00, 0x11, 0x40,
+		0xe4, 0xa8, 0x0c, 0xf3, 0x08, 0x00, 0x19, 0x40, 0x00, 0x00, 0x00, 0x00,
+		0x08, 0x00, 0x1a, 0x40, 0x00, 0x00, 0x02, 0x28, 0x08, 0x00, 0x18, 0x40,
+		0x00, 0x00, 0x00, 0x02, 0x34, 0x00, 0x08, 0x80, 0x18, 0x00, 0x07, 0x80,
+		0x0c, 0x00, 0x01, 0x80, 0x08, 0x00, 0x01, 0x00, 0x0a, 0x2a, 0x01, 0x05,
+		0x05, 0x00, 0x03, 0x00, 0x20, 0x00, 0x00, 0x00, 0x18, 0x00, 0x07, 0x80,
+		0x0c, 0x00, 0x01, 0x80, 0x08, 0x00, 0x01, 0x00, 0x0a, 0x2a, 0x01, 0x07,
+		0x05, 0x00, 0x03, 0x00, 0x20, 0x00, 0x00, 0x00,
+	}
+)
+
+func TestParseEntries(t *testing.T) {
+	tests := []struct {
+		name string
+		msgs [][]byte
+		want []string
+	}{
+		{
+			name: "subnets",
+			msgs: [][]byte{listNets},
+			want: []string{"192.168.0.0/16", "10.42.2.0/24", "10.42.0.0/16"},
+		},
+		{
+			name: "hosts",
+			msgs: [][]byte{listHosts},
+			want: []string{"10.42.1.5/32", "10.42.1.7/32"},
+		},
+		{
+			name: "several answers",
+			msgs: [][]byte{listHosts, listNets},
+			want: []string{"10.42.1.5/32", "10.42.1.7/32", "192.168.0.0/16", "10.42.2.0/24", "10.42.0.0/16"},
+		},
+		{
+			name: "header only",
+			msgs: [][]byte{listNets[:nfnetlink.SizeofNfgenmsg]},
+		},
+		{
+			name: "truncated header",
+			msgs: [][]byte{listNets[:2], listHosts},
+			want: []string{"10.42.1.5/32", "10.42.1.7/32"},
+		},
+	}
+	for _, tt := range tests {
+		got, err := parseEntries(tt.msgs)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseEntry(t *testing.T) {
+	ipAttr := func(ip []byte) *nl.RtAttr {
+		a := nl.NewRtAttr(attrIP|nfnetlink.NlaFNested, nil)
+		nl.NewRtAttrChild(a, attrIPAddrIPv4|nfnetlink.NlaFNetByteorder, ip)
+		return a
+	}
+	data := func(attrs ...*nl.RtAttr) []byte {
+		var b []byte
+		for _, a := range attrs {
+			b = append(b, a.Serialize()...)
+		}
+		return b
+	}
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "subnet",
+			data: data(ipAttr([]byte{10, 42, 0, 0}), nl.NewRtAttr(attrCIDR, nl.Uint8Attr(16))),
+			want: "10.42.0.0/16",
+		},
+		{
+			name: "no cidr",
+			data: data(ipAttr([]byte{10, 42, 1, 5})),
+			want: "10.42.1.5/32",
+		},
+		{
+			name:    "no ip",
+			data:    data(nl.NewRtAttr(attrCIDR, nl.Uint8Attr(16))),
+			wantErr: true,
+		},
+		{
+			name:    "ipv6",
+			data:    data(ipAttr(make([]byte, 16))),
+			wantErr: true,
+		},
+		{
+			name:    "truncated",
+			data:    data(ipAttr([]byte{10, 42, 0, 0}))[:6],
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := parseEntry(tt.data)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+//+build !linux
+
+package ipset
+
+import (
+	"github.com/pkg/errors"
+)
+
+func newNetlink() (Interface, error) {
+	return nil, errors.New("ipset over netlink is only supported on linux")
+}
@@ -0,0 +1,159 @@
+// Package iptables manages user chains through the iptables binaries. Rules
+// are the arguments following the chain name, in the form iptables -S prints
+// them.
+package iptables
+
+import (
+	"bytes"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/per-host-subnet/internal/command"
+)
+
+const (
+	TableNAT = "nat"
+
+	ChainPostrouting = "POSTROUTING"
+
+	// MaxChainLen is the longest chain name, XT_EXTENSION_MAXNAMELEN
+	// includes the trailing NUL.
+	MaxChainLen = 28
+)
+
+var versionRe = regexp.MustCompile(`v(\d+)\.(\d+)\.(\d+)`)
+
+type IPTables struct {
+	path        string
+	restorePath string
+	// restoreWait tells iptables-restore takes the xtables lock with -w,
+	// which it does since 1.6.2.
+	restoreWait bool
+}
+
+func New() (*IPTables, error) {
+	path, err := exec.LookPath("iptables")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to lookup iptables")
+	}
+	restorePath, err := exec.LookPath("iptables-restore")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to lookup iptables-restore")
+	}
+	out, err := exec.Command(path, "--version").CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrap(command.Error(err, out), "Failed to get the iptables version")
+	}
+	return &IPTables{
+		path:        path,
+		restorePath: restorePath,
+		restoreWait: versionAtLeast(string(out), 1, 6, 2),
+	}, nil
+}
+
+// versionAtLeast tells if the version iptables --version printed is at least
+// major.minor.patch, false when it can't be parsed.
+func versionAtLeast(out string, major, minor, patch int) bool {
+	m := versionRe.FindStringSubmatch(out)
+	if m == nil {
+		return false
+	}
+	want := []int{major, minor, patch}
+	for i, s := range m[1:] {
+		v, _ := strconv.Atoi(s)
+		if v != want[i] {
+			return v > want[i]
+		}
+	}
+	return true
+}
+
+// Rules returns the rules of chain, exists is false when there's no such
+// chain.
+func (t *IPTables) Rules(table, chain string) (rules []string, exists bool, err error) {
+	out, err := exec.Command(t.path, "-w", "-t", table, "-S", chain).CombinedOutput()
+	if err != nil {
+		if isNotExist(out) {
+			return nil, false, nil
+		}
+		return nil, false, errors.Wrapf(command.Error(err, out), "Failed to list chain %s", chain)
+	}
+	prefix := "-A " + chain + " "
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			rules = append(rules, strings.TrimSpace(strings.TrimPrefix(line, prefix)))
+		}
+	}
+	return rules, true, nil
+}
+
+// ReplaceChain creates chain if needed and sets its rules in a single
+// iptables-restore transaction, the kernel never sees a partial chain.
+func (t *IPTables) ReplaceChain(table, chain string, rules []string) error {
+	var script bytes.Buffer
+	script.WriteString("*" + table + "\n")
+	script.WriteString(":" + chain + " - [0:0]\n")
+	for _, rule := range rules {
+		script.WriteString("-A " + chain + " " + rule + "\n")
+	}
+	script.WriteString("COMMIT\n")
+	args := []string{"--noflush"}
+	if t.restoreWait {
+		args = append(args, "-w")
+	}
+	cmd := exec.Command(t.restorePath, args...)
+	cmd.Stdin = &script
+	out, err := cmd.CombinedOutput()
+	return errors.Wrapf(command.Error(err, out), "Failed to replace chain %s", chain)
+}
+
+// DeleteChain flushes and deletes chain, a missing chain succeeds.
+func (t *IPTables) DeleteChain(table, chain string) error {
+	for _, op := range []string{"-F", "-X"} {
+		out, err := exec.Command(t.path, "-w", "-t", table, op, chain).CombinedOutput()
+		if err != nil && !isNotExist(out) {
+			return errors.Wrapf(command.Error(err, out), "Failed to delete chain %s", chain)
+		}
+	}
+	return nil
+}
+
+func (t *IPTables) Exists(table, chain, rule string) (bool, error) {
+	args := append([]string{"-w", "-t", table, "-C", chain}, strings.Fields(rule)...)
+	out, err := exec.Command(t.path, args...).CombinedOutput()
+	if err == nil {
+		return true, nil
+	}
+	if isNotExist(out) {
+		return false, nil
+	}
+	return false, errors.Wrapf(command.Error(err, out), "Failed to check rule in chain %s", chain)
+}
+
+// Insert adds rule at position pos of chain, counting from 1.
+func (t *IPTables) Insert(table, chain string, pos int, rule string) error {
+	args := append([]string{"-w", "-t", table, "-I", chain, strconv.Itoa(pos)}, strings.Fields(rule)...)
+	out, err := exec.Command(t.path, args...).CombinedOutput()
+	return errors.Wrapf(command.Error(err, out), "Failed to insert rule in chain %s", chain)
+}
+
+// Delete removes rule from chain, a missing rule or chain succeeds.
+func (t *IPTables) Delete(table, chain, rule string) error {
+	args := append([]string{"-w", "-t", table, "-D", chain}, strings.Fields(rule)...)
+	out, err := exec.Command(t.path, args...).CombinedOutput()
+	if err != nil && !isNotExist(out) {
+		return errors.Wrapf(command.Error(err, out), "Failed to delete rule from chain %s", chain)
+	}
+	return nil
+}
+
+// isNotExist tells if iptables failed on a missing chain, rule or target.
+func isNotExist(out []byte) bool {
+	s := string(out)
+	return strings.Contains(s, "No chain/target/match by that name") ||
+		strings.Contains(s, "does a matching rule exist") ||
+		strings.Contains(s, "Couldn't load target")
+}
@@ -2,16 +2,30 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
-	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/per-host-subnet/config"
+	"github.com/rancher/per-host-subnet/egress"
+	"github.com/rancher/per-host-subnet/failover"
 	"github.com/rancher/per-host-subnet/hostnat"
 	"github.com/rancher/per-host-subnet/hostports"
+	"github.com/rancher/per-host-subnet/ipset"
+	"github.com/rancher/per-host-subnet/iptables"
+	"github.com/rancher/per-host-subnet/reconcile"
 	"github.com/rancher/per-host-subnet/register"
 	"github.com/rancher/per-host-subnet/routeupdate"
+	_ "github.com/rancher/per-host-subnet/routeupdate/hostgw"
+	_ "github.com/rancher/per-host-subnet/routeupdate/routefile"
+	"github.com/rancher/per-host-subnet/selector"
+	"github.com/rancher/per-host-subnet/server"
 	"github.com/rancher/per-host-subnet/setting"
+	"github.com/rancher/per-host-subnet/state"
 	"github.com/urfave/cli"
 )
 
@@ -23,24 +37,245 @@ func main() {
 	app.Version = VERSION
 	app.Usage = "Support per-host-subnet networking"
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "config",
+			Usage:  "YAML file setting any of these flags by name, the flags and env vars take precedence. Reloaded on SIGHUP",
+			EnvVar: "RANCHER_CONFIG",
+		},
 		cli.BoolFlag{
 			Name:   "debug, d",
 			EnvVar: "RANCHER_DEBUG",
 		},
-		cli.StringFlag{
+		cli.StringSliceFlag{
 			Name:   "metadata-address",
-			Value:  setting.DefaultMetadataAddress,
+			Usage:  "Metadata address, repeat to fail over to the next ones in order (default: " + setting.DefaultMetadataAddress + ")",
 			EnvVar: "RANCHER_METADATA_ADDRESS",
 		},
+		cli.StringFlag{
+			Name:   "metadata-api-version",
+			Value:  setting.DefaultMetadataAPIVersion,
+			EnvVar: "RANCHER_METADATA_API_VERSION",
+		},
 		cli.BoolFlag{
 			Name:   "enable-route-update",
 			EnvVar: "RANCHER_ENABLE_ROUTE_UPDATE",
 		},
 		cli.StringFlag{
 			Name:   "route-update-provider",
+			Usage:  "Comma separated route update providers, see the providers command. Every peer is routed by the first one whose selector matches",
 			EnvVar: "RANCHER_ROUTE_UPDATE_PROVIDER",
 			Value:  setting.DefaultRouteUpdateProvider,
 		},
+		cli.StringSliceFlag{
+			Name:   "route-update-option",
+			Usage:  "Route update provider option, as key=value or provider.key=value to set it for a single provider",
+			EnvVar: "RANCHER_ROUTE_UPDATE_OPTION",
+		},
+		// No EnvVar, the env value would be split on the commas of the selector.
+		cli.StringSliceFlag{
+			Name:  "route-update-selector",
+			Usage: "Peers routed by a provider, as provider=selector, e.g. hostgw=zone=a,!edge. A provider without selector matches every peer",
+		},
+		cli.DurationFlag{
+			Name:   "poll-interval",
+			Usage:  "How often the metadata version is checked",
+			EnvVar: "RANCHER_POLL_INTERVAL",
+			Value:  setting.DefaultPollInterval,
+		},
+		cli.Float64Flag{
+			Name:   "poll-jitter",
+			Usage:  "Random delay added to every poll, as a fraction of poll-interval",
+			EnvVar: "RANCHER_POLL_JITTER",
+			Value:  setting.DefaultPollJitter,
+		},
+		cli.DurationFlag{
+			Name:   "resync-interval",
+			Usage:  "Force a full reconcile of every subsystem this often, 0 to disable",
+			EnvVar: "RANCHER_RESYNC_INTERVAL",
+			Value:  setting.DefaultResyncInterval,
+		},
+		cli.StringSliceFlag{
+			Name:   "subsystem-resync-interval",
+			Usage:  "Override resync-interval for one subsystem, as name=duration",
+			EnvVar: "RANCHER_SUBSYSTEM_RESYNC_INTERVAL",
+		},
+		cli.DurationFlag{
+			Name:   "retry-initial-backoff",
+			Usage:  "Delay before the first retry of a failed route, ipset or port mapping",
+			EnvVar: "RANCHER_RETRY_INITIAL_BACKOFF",
+			Value:  setting.DefaultRetryInitialBackoff,
+		},
+		cli.DurationFlag{
+			Name:   "retry-max-backoff",
+			Usage:  "Maximum delay between retries of a failed item",
+			EnvVar: "RANCHER_RETRY_MAX_BACKOFF",
+			Value:  setting.DefaultRetryMaxBackoff,
+		},
+		cli.Float64Flag{
+			Name:   "max-delete-fraction",
+			Usage:  "Largest fraction of owned routes or ipset entries deleted in one pass without confirmation",
+			EnvVar: "RANCHER_MAX_DELETE_FRACTION",
+			Value:  setting.DefaultMaxDeleteFraction,
+		},
+		cli.IntFlag{
+			Name:   "delete-confirm-versions",
+			Usage:  "Consecutive metadata versions needed to confirm a mass deletion",
+			EnvVar: "RANCHER_DELETE_CONFIRM_VERSIONS",
+			Value:  setting.DefaultDeleteConfirmVersions,
+		},
+		cli.StringFlag{
+			Name:   "host-selector",
+			Usage:  "Only route to and exempt from NAT the peers matching this label selector, e.g. io.rancher.network.per_host_subnet.enabled=true",
+			EnvVar: "RANCHER_HOST_SELECTOR",
+		},
+		cli.StringFlag{
+			Name:   "drain-label",
+			Usage:  "Host label draining a host when true: the other hosts withdraw their routes to it and its agent stops reconciling",
+			EnvVar: "RANCHER_DRAIN_LABEL",
+			Value:  setting.DefaultDrainLabel,
+		},
+		cli.StringFlag{
+			Name:   "subnet-label",
+			Usage:  "Host label holding the host subnet",
+			EnvVar: "RANCHER_SUBNET_LABEL",
+			Value:  setting.DefaultSubnetLabel,
+		},
+		cli.StringFlag{
+			Name:   "router-ip-label",
+			Usage:  "Host label holding the router IP, windows only",
+			EnvVar: "RANCHER_ROUTER_IP_LABEL",
+			Value:  setting.DefaultRouterIPLabel,
+		},
+		cli.StringFlag{
+			Name:   "agent-ip-label",
+			Usage:  "Host label overriding the agent IP used as gateway, linux only",
+			EnvVar: "RANCHER_AGENT_IP_LABEL",
+			Value:  setting.DefaultAgentIPLabel,
+		},
+		cli.StringFlag{
+			Name:   "nat-exempt-key",
+			Usage:  "Network metadata key listing extra subnets exempted from host NAT, linux only",
+			EnvVar: "RANCHER_NAT_EXEMPT_KEY",
+			Value:  setting.DefaultNATExemptKey,
+		},
+		cli.StringFlag{
+			Name:   "no-masquerade-label",
+			Usage:  "Container label, set to true, keeping the container source IP on every destination, linux only",
+			EnvVar: "RANCHER_NO_MASQUERADE_LABEL",
+			Value:  setting.DefaultNoMasqueradeLabel,
+		},
+		cli.StringFlag{
+			Name:   "force-masquerade-label",
+			Usage:  "Container label, set to true, masquerading the container even towards the exempted subnets, linux only",
+			EnvVar: "RANCHER_FORCE_MASQUERADE_LABEL",
+			Value:  setting.DefaultForceMasqueradeLabel,
+		},
+		cli.StringFlag{
+			Name:   "snat-address-label",
+			Usage:  "Host label holding the address the host subnet traffic is SNATed to, instead of masqueraded, linux only",
+			EnvVar: "RANCHER_SNAT_ADDRESS_LABEL",
+			Value:  setting.DefaultSNATAddressLabel,
+		},
+		cli.StringFlag{
+			Name:   "egress-label",
+			Usage:  "Container label, set to true, sending the container traffic out of the cluster through the egress gateway, linux only",
+			EnvVar: "RANCHER_EGRESS_LABEL",
+			Value:  setting.DefaultEgressLabel,
+		},
+		cli.StringFlag{
+			Name:   "egress-gateway-label",
+			Usage:  "Host label making the host the egress gateway, holding the address egress traffic is SNATed to, linux only",
+			EnvVar: "RANCHER_EGRESS_GATEWAY_LABEL",
+			Value:  setting.DefaultEgressGatewayLabel,
+		},
+		cli.IntFlag{
+			Name:   "egress-table",
+			Usage:  "Routing table dedicated to the egress routes, linux only",
+			EnvVar: "RANCHER_EGRESS_TABLE",
+			Value:  setting.DefaultEgressTable,
+		},
+		cli.IntFlag{
+			Name:   "egress-rule-priority",
+			Usage:  "Priority of the rules looking up the egress routing table, dedicated to them, linux only",
+			EnvVar: "RANCHER_EGRESS_RULE_PRIORITY",
+			Value:  setting.DefaultEgressRulePriority,
+		},
+		cli.StringSliceFlag{
+			Name:   "nat-exempt-cidr",
+			Usage:  "Extra subnet exempted from host NAT, like the subnets of the other hosts, linux only",
+			EnvVar: "RANCHER_NAT_EXEMPT_CIDRS",
+		},
+		cli.StringFlag{
+			Name:   "nat-ipset-name",
+			Usage:  "Name of the ipset holding the subnets exempted from host NAT",
+			EnvVar: "RANCHER_NAT_IPSET_NAME",
+			Value:  setting.DefaultDisableHostNATIPset,
+		},
+		cli.StringFlag{
+			Name:   "no-masquerade-ipset-name",
+			Usage:  "Name of the ipset holding the containers opted out of host NAT",
+			EnvVar: "RANCHER_NO_MASQUERADE_IPSET_NAME",
+			Value:  setting.DefaultNoMasqueradeIPSet,
+		},
+		cli.StringFlag{
+			Name:   "force-masquerade-ipset-name",
+			Usage:  "Name of the ipset holding the containers always masqueraded",
+			EnvVar: "RANCHER_FORCE_MASQUERADE_IPSET_NAME",
+			Value:  setting.DefaultForceMasqueradeIPSet,
+		},
+		cli.StringFlag{
+			Name:   "egress-ipset-name",
+			Usage:  "Name of the ipset holding the egress containers on the egress gateway",
+			EnvVar: "RANCHER_EGRESS_IPSET_NAME",
+			Value:  setting.DefaultEgressIPSet,
+		},
+		cli.StringFlag{
+			Name:   "nat-chain",
+			Usage:  "Name of the iptables nat chain masquerading the local subnet traffic, linux only",
+			EnvVar: "RANCHER_NAT_CHAIN",
+			Value:  setting.DefaultNATChain,
+		},
+		cli.StringFlag{
+			Name:   "nat-table",
+			Usage:  "Name of the nftables table holding the NAT exemption set and rules, linux only",
+			EnvVar: "RANCHER_NAT_TABLE",
+			Value:  setting.DefaultNATTable,
+		},
+		cli.StringFlag{
+			Name:   "hostports-network",
+			Usage:  "Name of the network whose containers get host port mappings, windows only",
+			EnvVar: "RANCHER_HOSTPORTS_NETWORK",
+			Value:  setting.DefaultHostPortsNetwork,
+		},
+		cli.StringFlag{
+			Name:   "nat-backend",
+			Usage:  "How to exempt the peer subnets from host NAT: iptables with an ipset, or nftables",
+			EnvVar: "RANCHER_NAT_BACKEND",
+			Value:  setting.DefaultNATBackend,
+		},
+		cli.StringFlag{
+			Name:   "ipset-backend",
+			Usage:  "How to manage the NAT exemption ipset: netlink, exec to run the ipset binary, or auto to use netlink when available",
+			EnvVar: "RANCHER_IPSET_BACKEND",
+			Value:  ipset.BackendAuto,
+		},
+		cli.BoolFlag{
+			Name:   "flush-conntrack",
+			Usage:  "Delete the connection tracking entries from the local subnet, and the egress containers on the egress gateway, to the subnets added to or removed from the NAT exemption, so established connections follow the change, linux only",
+			EnvVar: "RANCHER_FLUSH_CONNTRACK",
+		},
+		cli.StringFlag{
+			Name:   "state-dir",
+			Usage:  "Directory keeping the last known good metadata and the objects created by the agent, empty to disable",
+			EnvVar: "RANCHER_STATE_DIR",
+			Value:  setting.DefaultStateDir,
+		},
+		cli.StringFlag{
+			Name:   "status-address",
+			Usage:  "Address serving the status on /status and metrics on /metrics, empty to disable",
+			EnvVar: "RANCHER_STATUS_ADDRESS",
+			Value:  setting.DefaultStatusAddress,
+		},
 		cli.BoolFlag{
 			Name:  "register-service",
 			Usage: "Register windows service, invalid for non windows OS.",
@@ -50,6 +285,13 @@ func main() {
 			Usage: "Unregister windows service, invalid for non windows OS.",
 		},
 	}
+	app.Commands = []cli.Command{
+		{
+			Name:   "providers",
+			Usage:  "List the route update providers",
+			Action: listProviders,
+		},
+	}
 	app.Action = appMain
 	if err := app.Run(os.Args); err != nil {
 		logrus.Fatal(err)
@@ -57,7 +299,11 @@ func main() {
 }
 
 func appMain(ctx *cli.Context) error {
-	if ctx.Bool("debug") {
+	c, err := config.Load(ctx, ctx.String("config"))
+	if err != nil {
+		return err
+	}
+	if c.Bool("debug") {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
@@ -68,28 +314,319 @@ func appMain(ctx *cli.Context) error {
 		return err
 	}
 
+	routeRules, err := routeUpdateRules(c)
+	if err != nil {
+		return err
+	}
+	if err := applyNames(c); err != nil {
+		return err
+	}
+
 	done := make(chan error)
 
-	m, err := metadata.NewClientAndWait(fmt.Sprintf(setting.MetadataURL, ctx.String("metadata-address")))
+	// Don't wait for metadata, the reconciler converges from the cached
+	// snapshot when it's unreachable.
+	addresses := c.StringSlice("metadata-address")
+	if len(addresses) == 0 {
+		addresses = []string{setting.DefaultMetadataAddress}
+	}
+	var urls []string
+	for _, address := range addresses {
+		urls = append(urls, fmt.Sprintf(setting.MetadataURL, address, c.String("metadata-api-version")))
+	}
+	m := failover.NewClient(urls)
+
+	opts, err := reconcileOptions(c)
+	if err != nil {
+		return err
+	}
+	opts.CacheFile, opts.State, err = stateOptions(c)
 	if err != nil {
-		return errors.Wrap(err, "Failed to create metadata client")
+		return err
 	}
+	r := reconcile.New(m, opts)
+	r.OnReload(func() error {
+		newConfig, err := reload(c, r)
+		if err != nil {
+			return err
+		}
+		c = newConfig
+		return nil
+	})
 
-	if ctx.Bool("enable-route-update") {
-		_, err := routeupdate.Run(ctx.String("route-update-provider"), m)
+	// Subsystems are reconciled in registration order: routes to the other
+	// hosts come first so NAT exemption never points at an unreachable subnet.
+	if c.Bool("enable-route-update") {
+		_, err := routeupdate.RunChain(routeRules, r)
 		if err != nil {
 			return err
 		}
 	}
 
-	err = hostnat.Watch(m)
+	err = hostnat.Watch(r, c.String("nat-backend"), c.String("ipset-backend"), c.Bool("flush-conntrack"))
 	if err != nil {
 		return err
 	}
 
-	err = hostports.Watch(m)
+	err = egress.Watch(r, c.Int("egress-table"), c.Int("egress-rule-priority"))
 	if err != nil {
 		return err
 	}
+
+	err = hostports.Watch(r)
+	if err != nil {
+		return err
+	}
+
+	if address := c.String("status-address"); address != "" {
+		if err := server.ListenAndServe(address, r, m); err != nil {
+			return err
+		}
+	}
+
+	go func() {
+		for range register.ReloadSignal() {
+			r.Reload()
+		}
+	}()
+
+	r.Start()
 	return <-done
 }
+
+// reload applies a new read of the config file. The settings used to start
+// the subsystems, like the metadata address or the route update providers,
+// need a restart.
+func reload(c *config.Config, r *reconcile.Reconciler) (*config.Config, error) {
+	newConfig, err := c.Reload()
+	if err != nil {
+		return nil, err
+	}
+	opts, err := reconcileOptions(newConfig)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyNames(newConfig); err != nil {
+		return nil, err
+	}
+	r.SetOptions(opts)
+	if newConfig.Bool("debug") {
+		logrus.SetLevel(logrus.DebugLevel)
+	} else {
+		logrus.SetLevel(logrus.InfoLevel)
+	}
+	for _, name := range c.Changed(newConfig) {
+		if !reloadable[name] {
+			logrus.Warnf("Setting %s changed, it only applies after a restart", name)
+		}
+	}
+	return newConfig, nil
+}
+
+var reloadable = map[string]bool{
+	"debug":                       true,
+	"host-selector":               true,
+	"drain-label":                 true,
+	"poll-interval":               true,
+	"poll-jitter":                 true,
+	"resync-interval":             true,
+	"subsystem-resync-interval":   true,
+	"retry-initial-backoff":       true,
+	"retry-max-backoff":           true,
+	"max-delete-fraction":         true,
+	"delete-confirm-versions":     true,
+	"subnet-label":                true,
+	"router-ip-label":             true,
+	"agent-ip-label":              true,
+	"nat-exempt-key":              true,
+	"nat-exempt-cidr":             true,
+	"no-masquerade-label":         true,
+	"force-masquerade-label":      true,
+	"snat-address-label":          true,
+	"egress-label":                true,
+	"egress-gateway-label":        true,
+	"nat-ipset-name":              true,
+	"no-masquerade-ipset-name":    true,
+	"force-masquerade-ipset-name": true,
+	"egress-ipset-name":           true,
+	"nat-chain":                   true,
+	"nat-table":                   true,
+	"hostports-network":           true,
+}
+
+// applyNames validates and sets the label keys, object names and extra NAT
+// exempt subnets.
+func applyNames(c *config.Config) error {
+	names := map[string]*string{
+		"subnet-label":                &setting.SubnetLabel,
+		"router-ip-label":             &setting.RouterIPLabel,
+		"agent-ip-label":              &setting.AgentIPLabel,
+		"nat-exempt-key":              &setting.NATExemptKey,
+		"no-masquerade-label":         &setting.NoMasqueradeLabel,
+		"force-masquerade-label":      &setting.ForceMasqueradeLabel,
+		"snat-address-label":          &setting.SNATAddressLabel,
+		"egress-label":                &setting.EgressLabel,
+		"egress-gateway-label":        &setting.EgressGatewayLabel,
+		"nat-ipset-name":              &setting.NATIPSet,
+		"no-masquerade-ipset-name":    &setting.NoMasqueradeIPSet,
+		"force-masquerade-ipset-name": &setting.ForceMasqueradeIPSet,
+		"egress-ipset-name":           &setting.EgressIPSet,
+		"nat-chain":                   &setting.NATChain,
+		"nat-table":                   &setting.NATTable,
+		"hostports-network":           &setting.HostPortsNetwork,
+	}
+	for name := range names {
+		if c.String(name) == "" {
+			return errors.Errorf("%s must not be empty", name)
+		}
+	}
+	for _, name := range []string{"nat-ipset-name", "no-masquerade-ipset-name", "force-masquerade-ipset-name", "egress-ipset-name"} {
+		if len(c.String(name)) > ipset.MaxNameLen {
+			return errors.Errorf("%s must not be longer than %d characters", name, ipset.MaxNameLen)
+		}
+	}
+	if len(c.String("nat-chain")) > iptables.MaxChainLen {
+		return errors.Errorf("nat-chain must not be longer than %d characters", iptables.MaxChainLen)
+	}
+	cidrs := c.StringSlice("nat-exempt-cidr")
+	for _, cidr := range cidrs {
+		ip, _, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return errors.Wrap(err, "Invalid nat-exempt-cidr")
+		}
+		if ip.To4() == nil {
+			return errors.Errorf("Invalid nat-exempt-cidr %s, only IPv4 is supported", cidr)
+		}
+	}
+	for name, v := range names {
+		*v = c.String(name)
+	}
+	setting.NATExemptCIDRs = cidrs
+	return nil
+}
+
+func stateOptions(c *config.Config) (string, *state.Store, error) {
+	cacheFile, stateFile := "", ""
+	if dir := c.String("state-dir"); dir != "" {
+		cacheFile = filepath.Join(dir, setting.MetadataCacheFile)
+		stateFile = filepath.Join(dir, setting.StateFile)
+	}
+	store, err := state.Open(stateFile)
+	return cacheFile, store, err
+}
+
+func reconcileOptions(c *config.Config) (reconcile.Options, error) {
+	opts := reconcile.Options{
+		PollInterval:             c.Duration("poll-interval"),
+		PollJitter:               c.Float64("poll-jitter"),
+		ResyncInterval:           c.Duration("resync-interval"),
+		SubsystemResyncIntervals: map[string]time.Duration{},
+		RetryInitialBackoff:      c.Duration("retry-initial-backoff"),
+		RetryMaxBackoff:          c.Duration("retry-max-backoff"),
+		MaxDeleteFraction:        c.Float64("max-delete-fraction"),
+		DeleteConfirmVersions:    c.Int("delete-confirm-versions"),
+		DrainLabel:               c.String("drain-label"),
+	}
+	sel, err := selector.Parse(c.String("host-selector"))
+	if err != nil {
+		return opts, err
+	}
+	opts.HostSelector = sel
+	if opts.PollInterval <= 0 {
+		return opts, errors.New("poll-interval must be positive")
+	}
+	if opts.PollJitter < 0 || opts.PollJitter > 1 {
+		return opts, errors.New("poll-jitter must be between 0 and 1")
+	}
+	if opts.RetryInitialBackoff <= 0 || opts.RetryMaxBackoff < opts.RetryInitialBackoff {
+		return opts, errors.New("retry-initial-backoff must be positive and not above retry-max-backoff")
+	}
+	if opts.MaxDeleteFraction < 0 || opts.MaxDeleteFraction > 1 {
+		return opts, errors.New("max-delete-fraction must be between 0 and 1")
+	}
+	if opts.DeleteConfirmVersions < 1 {
+		return opts, errors.New("delete-confirm-versions must be at least 1")
+	}
+	for _, v := range c.StringSlice("subsystem-resync-interval") {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return opts, errors.Errorf("Invalid subsystem-resync-interval %q, expected name=duration", v)
+		}
+		d, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return opts, errors.Wrapf(err, "Invalid subsystem-resync-interval %q", v)
+		}
+		opts.SubsystemResyncIntervals[parts[0]] = d
+	}
+	return opts, nil
+}
+
+// routeUpdateRules builds the provider chain, in the order of
+// route-update-provider.
+func routeUpdateRules(c *config.Config) ([]routeupdate.Rule, error) {
+	var rules []routeupdate.Rule
+	index := map[string]int{}
+	for _, name := range strings.Split(c.String("route-update-provider"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if err := routeupdate.Validate(name); err != nil {
+			return nil, err
+		}
+		if _, ok := index[name]; ok {
+			return nil, errors.Errorf("Route update provider %s is listed twice", name)
+		}
+		index[name] = len(rules)
+		rules = append(rules, routeupdate.Rule{
+			Provider: name,
+			Options:  routeupdate.Options{},
+		})
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("No route update provider")
+	}
+
+	for _, v := range c.StringSlice("route-update-option") {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("Invalid route-update-option %q, expected key=value", v)
+		}
+		key := parts[0]
+		if i := strings.Index(key, "."); i >= 0 {
+			n, ok := index[key[:i]]
+			if !ok {
+				return nil, errors.Errorf("Invalid route-update-option %q, provider %s is not in use", v, key[:i])
+			}
+			rules[n].Options[key[i+1:]] = parts[1]
+			continue
+		}
+		for n := range rules {
+			rules[n].Options[key] = parts[1]
+		}
+	}
+
+	for _, v := range c.StringSlice("route-update-selector") {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("Invalid route-update-selector %q, expected provider=selector", v)
+		}
+		n, ok := index[parts[0]]
+		if !ok {
+			return nil, errors.Errorf("Invalid route-update-selector %q, provider %s is not in use", v, parts[0])
+		}
+		sel, err := selector.Parse(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		rules[n].Selector = sel
+	}
+	return rules, nil
+}
+
+func listProviders(ctx *cli.Context) error {
+	for _, p := range routeupdate.Providers() {
+		fmt.Printf("%-12s %s\n", p.Name, p.Description)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+// Package nftables manages whole tables through the nft binary. A table is
+// always replaced in a single transaction, the kernel never sees it half
+// written.
+package nftables
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/per-host-subnet/internal/command"
+)
+
+const (
+	FamilyIP = "ip"
+
+	// MaxNameLen is the longest table, set or chain name the kernel takes.
+	MaxNameLen = 255
+)
+
+type Table struct {
+	Family string
+	Name   string
+	Sets   []Set
+	Chains []Chain
+}
+
+type Set struct {
+	Name     string
+	Type     string
+	Flags    string
+	Elements []string
+}
+
+// Chain is a base chain when Base is set, like "type nat hook postrouting
+// priority 100; policy accept;". Get doesn't fill Base, nft prints it in
+// another form than it reads it.
+type Chain struct {
+	Name  string
+	Base  string
+	Rules []string
+}
+
+type NFTables struct {
+	path string
+}
+
+func New() (*NFTables, error) {
+	path, err := exec.LookPath("nft")
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to lookup nft")
+	}
+	return &NFTables{path: path}, nil
+}
+
+// Get returns the table of family named name, nil when there's none.
+func (n *NFTables) Get(family, name string) (*Table, error) {
+	out, err := exec.Command(n.path, "list", "table", family, name).CombinedOutput()
+	if err != nil {
+		if isNotExist(out) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(command.Error(err, out), "Failed to list table %s", name)
+	}
+	return parseTable(family, name, string(out))
+}
+
+// Replace creates t or replaces the existing table of the same name.
+func (n *NFTables) Replace(t *Table) error {
+	var script bytes.Buffer
+	// Declaring the table first makes the delete succeed when it's missing.
+	script.WriteString("table " + t.Family + " " + t.Name + " {}\n")
+	script.WriteString("delete table " + t.Family + " " + t.Name + "\n")
+	script.WriteString("table " + t.Family + " " + t.Name + " {\n")
+	for _, s := range t.Sets {
+		script.WriteString("\tset " + s.Name + " {\n")
+		script.WriteString("\t\ttype " + s.Type + "\n")
+		if s.Flags != "" {
+			script.WriteString("\t\tflags " + s.Flags + "\n")
+		}
+		if len(s.Elements) > 0 {
+			script.WriteString("\t\telements = { " + strings.Join(s.Elements, ", ") + " }\n")
+		}
+		script.WriteString("\t}\n")
+	}
+	for _, c := range t.Chains {
+		script.WriteString("\tchain " + c.Name + " {\n")
+		if c.Base != "" {
+			script.WriteString("\t\t" + c.Base + "\n")
+		}
+		for _, r := range c.Rules {
+			script.WriteString("\t\t" + r + "\n")
+		}
+		script.WriteString("\t}\n")
+	}
+	script.WriteString("}\n")
+	return errors.Wrapf(n.run(&script), "Failed to replace table %s", t.Name)
+}
+
+// Delete removes the table of family named name, a missing table succeeds.
+func (n *NFTables) Delete(family, name string) error {
+	script := bytes.NewBufferString("table " + family + " " + name + " {}\ndelete table " + family + " " + name + "\n")
+	return errors.Wrapf(n.run(script), "Failed to delete table %s", name)
+}
+
+func (n *NFTables) run(script *bytes.Buffer) error {
+	cmd := exec.Command(n.path, "-f", "-")
+	cmd.Stdin = script
+	out, err := cmd.CombinedOutput()
+	return command.Error(err, out)
+}
+
+// parseTable reads the sets and chains of the nft list output.
+func parseTable(family, name, out string) (*Table, error) {
+	t := &Table{
+		Family: family,
+		Name:   name,
+	}
+	var set *Set
+	var chain *Chain
+	inElements := false
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case inElements:
+			set.Elements = append(set.Elements, elements(line)...)
+			inElements = !strings.HasSuffix(line, "}")
+		case strings.HasPrefix(line, "set ") && strings.HasSuffix(line, "{"):
+			t.Sets = append(t.Sets, Set{Name: strings.Fields(line)[1]})
+			set = &t.Sets[len(t.Sets)-1]
+		case strings.HasPrefix(line, "chain ") && strings.HasSuffix(line, "{"):
+			t.Chains = append(t.Chains, Chain{Name: strings.Fields(line)[1]})
+			chain = &t.Chains[len(t.Chains)-1]
+		case line == "}":
+			set, chain = nil, nil
+		case set != nil:
+			switch {
+			case strings.HasPrefix(line, "type "):
+				set.Type = strings.TrimPrefix(line, "type ")
+			case strings.HasPrefix(line, "flags "):
+				set.Flags = strings.TrimPrefix(line, "flags ")
+			case strings.HasPrefix(line, "elements = {"):
+				line = strings.TrimPrefix(line, "elements = {")
+				set.Elements = append(set.Elements, elements(line)...)
+				inElements = !strings.HasSuffix(line, "}")
+			}
+		case chain != nil:
+			if line != "" && !strings.HasPrefix(line, "type ") {
+				chain.Rules = append(chain.Rules, line)
+			}
+		}
+	}
+	if inElements {
+		return nil, errors.Errorf("Failed to parse table %s: unterminated set elements", name)
+	}
+	return t, nil
+}
+
+func elements(line string) []string {
+	var rtn []string
+	for _, e := range strings.Split(strings.TrimSuffix(line, "}"), ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			rtn = append(rtn, e)
+		}
+	}
+	return rtn
+}
+
+func isNotExist(out []byte) bool {
+	return strings.Contains(string(out), "No such file or directory")
+}
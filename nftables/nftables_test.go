@@ -0,0 +1,105 @@
+package nftables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTable(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		want    *Table
+		wantErr bool
+	}{
+		{
+			// As listed by nft v0.8.
+			name: "priority number",
+			out: `table ip rancher_per_host_subnet {
+	set nat_exempt {
+		type ipv4_addr
+		flags interval
+		elements = { 10.42.0.0/16, 192.168.0.0/16 }
+	}
+	set no_masquerade {
+		type ipv4_addr
+		flags interval
+		elements = { 10.42.1.5, 10.42.1.7 }
+	}
+	set force_masquerade {
+		type ipv4_addr
+		flags interval
+	}
+	chain postrouting {
+		type nat hook postrouting priority 100; policy accept;
+		ip saddr @no_masquerade return
+		ip saddr 10.42.1.0/24 ip daddr != 10.42.1.0/24 masquerade
+	}
+}
+`,
+			want: &Table{
+				Family: FamilyIP,
+				Name:   "rancher_per_host_subnet",
+				Sets: []Set{
+					{Name: "nat_exempt", Type: "ipv4_addr", Flags: "interval", Elements: []string{"10.42.0.0/16", "192.168.0.0/16"}},
+					{Name: "no_masquerade", Type: "ipv4_addr", Flags: "interval", Elements: []string{"10.42.1.5", "10.42.1.7"}},
+					{Name: "force_masquerade", Type: "ipv4_addr", Flags: "interval"},
+				},
+				Chains: []Chain{{
+					Name: "postrouting",
+					Rules: []string{
+						"ip saddr @no_masquerade return",
+						"ip saddr 10.42.1.0/24 ip daddr != 10.42.1.0/24 masquerade",
+					},
+				}},
+			},
+		},
+		{
+			// As listed by nft v1.0, long element lists are wrapped.
+			name: "wrapped elements",
+			out: `table ip rancher_per_host_subnet {
+	set nat_exempt {
+		type ipv4_addr
+		flags interval
+		elements = { 10.42.0.0/16, 10.43.0.0/16,
+			     10.44.0.0/16, 192.168.0.0/16 }
+	}
+	chain postrouting {
+		type nat hook postrouting priority srcnat; policy accept;
+		ip saddr 10.42.1.0/24 ip daddr @nat_exempt return
+	}
+}
+`,
+			want: &Table{
+				Family: FamilyIP,
+				Name:   "rancher_per_host_subnet",
+				Sets: []Set{
+					{Name: "nat_exempt", Type: "ipv4_addr", Flags: "interval", Elements: []string{"10.42.0.0/16", "10.43.0.0/16", "10.44.0.0/16", "192.168.0.0/16"}},
+				},
+				Chains: []Chain{{
+					Name:  "postrouting",
+					Rules: []string{"ip saddr 10.42.1.0/24 ip daddr @nat_exempt return"},
+				}},
+			},
+		},
+		{
+			name: "unterminated elements",
+			out: `table ip rancher_per_host_subnet {
+	set nat_exempt {
+		type ipv4_addr
+		elements = { 10.42.0.0/16,
+`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		got, err := parseTable(FamilyIP, "rancher_per_host_subnet", tt.out)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v, want error %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
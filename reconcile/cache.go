@@ -0,0 +1,44 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rancher/per-host-subnet/state"
+)
+
+// cachedSnapshot is the last known good snapshot as persisted on disk, so the
+// agent can converge from it when metadata is unreachable at startup.
+type cachedSnapshot struct {
+	SavedAt  time.Time `json:"savedAt"`
+	Snapshot *Snapshot `json:"snapshot"`
+}
+
+func saveCache(path string, s *Snapshot) error {
+	data, err := json.Marshal(cachedSnapshot{
+		SavedAt:  time.Now(),
+		Snapshot: s,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal metadata cache")
+	}
+	return state.WriteFileAtomic(path, data)
+}
+
+func loadCache(path string) (*Snapshot, time.Time, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "Failed to read metadata cache")
+	}
+	var c cachedSnapshot
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, time.Time{}, errors.Wrapf(err, "Failed to parse metadata cache %s", path)
+	}
+	if c.Snapshot == nil {
+		return nil, time.Time{}, errors.Errorf("Metadata cache %s is empty", path)
+	}
+	c.Snapshot.Cached = true
+	return c.Snapshot, c.SavedAt, nil
+}
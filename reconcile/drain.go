@@ -0,0 +1,37 @@
+package reconcile
+
+import (
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/rancher/go-rancher-metadata/metadata"
+)
+
+// isDrained reports whether reconciling is paused by the drain label of the
+// self host, logging when that changes. The label is the only way to drain a
+// host, it's what the other agents read too.
+func (r *Reconciler) isDrained(s *Snapshot) bool {
+	drained := r.hasDrainLabel(s.SelfHost)
+	r.Lock()
+	r.selfDrained = drained
+	r.Unlock()
+	if drained != r.drainLogged {
+		if drained {
+			logrus.Warnf("Host is DRAINED, reconciling is paused until it's undrained")
+		} else {
+			logrus.Info("Host is undrained, reconciling again")
+		}
+		r.drainLogged = drained
+	}
+	return drained
+}
+
+// hasDrainLabel tells if h is drained through its label, the other agents
+// then withdraw the routes to it and stop exempting it from NAT.
+func (r *Reconciler) hasDrainLabel(h metadata.Host) bool {
+	if r.opts.DrainLabel == "" {
+		return false
+	}
+	v, _ := strconv.ParseBool(h.Labels[r.opts.DrainLabel])
+	return v
+}
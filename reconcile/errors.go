@@ -0,0 +1,57 @@
+package reconcile
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// ItemError is the failure of a single operation, like adding one route.
+type ItemError struct {
+	Op     string `json:"op"`
+	Item   string `json:"item"`
+	Reason string `json:"reason"`
+}
+
+func (e ItemError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.Op, e.Item, e.Reason)
+}
+
+// MultiError collects the item failures of a reconcile pass. The zero value
+// is ready to use.
+type MultiError struct {
+	Items []ItemError
+}
+
+// Add records err for the item, a nil err is ignored.
+func (m *MultiError) Add(op, item string, err error) {
+	if err == nil {
+		return
+	}
+	m.Items = append(m.Items, ItemError{
+		Op:     op,
+		Item:   item,
+		Reason: err.Error(),
+	})
+}
+
+// ErrorOrNil returns m if any item failed, nil otherwise.
+func (m *MultiError) ErrorOrNil() error {
+	if len(m.Items) == 0 {
+		return nil
+	}
+	return m
+}
+
+func (m *MultiError) Error() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d item(s) failed", len(m.Items))
+	for i, e := range m.Items {
+		if i == 0 {
+			buf.WriteString(": ")
+		} else {
+			buf.WriteString("; ")
+		}
+		buf.WriteString(e.Error())
+	}
+	return buf.String()
+}
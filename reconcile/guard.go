@@ -0,0 +1,63 @@
+package reconcile
+
+import (
+	"github.com/Sirupsen/logrus"
+)
+
+// DeleteGuard protects against bad metadata, like an empty or truncated host
+// list, wiping out what a subsystem owns. A pass deleting more than
+// MaxFraction of the owned entries, or with no peer at all, is only allowed
+// once the same situation was seen over ConfirmVersions consecutive metadata
+// versions.
+//
+// A DeleteGuard has no locking: Allow and SetThresholds must only be called
+// from the reconciler goroutine, SetThresholds through SetOptions in an
+// OnReload function.
+type DeleteGuard struct {
+	name            string
+	maxFraction     float64
+	confirmVersions int
+	lastVersion     string
+	seenVersions    int
+}
+
+func NewDeleteGuard(name string, maxFraction float64, confirmVersions int) *DeleteGuard {
+	return &DeleteGuard{
+		name:            name,
+		maxFraction:     maxFraction,
+		confirmVersions: confirmVersions,
+	}
+}
+
+func (g *DeleteGuard) SetThresholds(maxFraction float64, confirmVersions int) {
+	g.maxFraction = maxFraction
+	g.confirmVersions = confirmVersions
+}
+
+// Allow reports whether toDelete of the owned entries may be deleted while
+// reconciling version. noPeers tells that metadata returned no other host.
+func (g *DeleteGuard) Allow(version string, owned, toDelete int, noPeers bool) bool {
+	if toDelete == 0 || (!noPeers && float64(toDelete) <= g.maxFraction*float64(owned)) {
+		g.lastVersion = ""
+		g.seenVersions = 0
+		return true
+	}
+
+	if version != g.lastVersion {
+		g.lastVersion = version
+		g.seenVersions++
+	}
+	fields := logrus.Fields{
+		"subsystem": g.name,
+		"owned":     owned,
+		"toDelete":  toDelete,
+		"noPeers":   noPeers,
+		"versions":  g.seenVersions,
+	}
+	if g.seenVersions >= g.confirmVersions {
+		logrus.WithFields(fields).Warn("Mass deletion confirmed by consecutive metadata versions, deleting")
+		return true
+	}
+	logrus.WithFields(fields).Warnf("REFUSING mass deletion until confirmed by %d consecutive metadata versions, metadata may be incomplete", g.confirmVersions)
+	return false
+}
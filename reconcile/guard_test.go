@@ -0,0 +1,92 @@
+package reconcile
+
+import (
+	"testing"
+)
+
+func TestDeleteGuardAllow(t *testing.T) {
+	type pass struct {
+		version  string
+		owned    int
+		toDelete int
+		noPeers  bool
+		want     bool
+	}
+	tests := []struct {
+		name   string
+		passes []pass
+	}{
+		{
+			name: "nothing to delete",
+			passes: []pass{
+				{"1", 10, 0, true, true},
+			},
+		},
+		{
+			name: "within the fraction",
+			passes: []pass{
+				{"1", 10, 5, false, true},
+			},
+		},
+		{
+			name: "mass deletion confirmed by new versions",
+			passes: []pass{
+				{"1", 10, 6, false, false},
+				{"2", 10, 6, false, false},
+				{"3", 10, 6, false, true},
+			},
+		},
+		{
+			name: "repeated version doesn't confirm",
+			passes: []pass{
+				{"1", 10, 6, false, false},
+				{"1", 10, 6, false, false},
+				{"1", 10, 6, false, false},
+				{"2", 10, 6, false, false},
+				{"3", 10, 6, false, true},
+			},
+		},
+		{
+			name: "no peers confirmed by new versions",
+			passes: []pass{
+				{"1", 10, 1, true, false},
+				{"2", 10, 1, true, false},
+				{"3", 10, 1, true, true},
+			},
+		},
+		{
+			name: "allowed pass resets the count",
+			passes: []pass{
+				{"1", 10, 6, false, false},
+				{"2", 10, 6, false, false},
+				{"3", 10, 1, false, true},
+				{"4", 10, 6, false, false},
+				{"5", 10, 6, false, false},
+				{"6", 10, 6, false, true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		g := NewDeleteGuard("test", 0.5, 3)
+		for i, p := range tt.passes {
+			if got := g.Allow(p.version, p.owned, p.toDelete, p.noPeers); got != p.want {
+				t.Errorf("%s: pass %d: got %v, want %v", tt.name, i+1, got, p.want)
+			}
+		}
+	}
+}
+
+func TestDeleteGuardSetThresholds(t *testing.T) {
+	g := NewDeleteGuard("test", 0.5, 3)
+	if g.Allow("1", 10, 6, false) {
+		t.Fatal("mass deletion allowed")
+	}
+	g.SetThresholds(0.5, 2)
+	if !g.Allow("2", 10, 6, false) {
+		t.Error("mass deletion not allowed after lowering the confirm versions")
+	}
+	g.SetThresholds(0.8, 2)
+	if !g.Allow("3", 10, 8, false) {
+		t.Error("deletion not allowed after raising the fraction")
+	}
+}
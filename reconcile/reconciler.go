@@ -0,0 +1,523 @@
+package reconcile
+
+import (
+	"encoding/json"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/per-host-subnet/selector"
+	"github.com/rancher/per-host-subnet/state"
+)
+
+const (
+	maxSnapshotAttempts = 3
+)
+
+// Snapshot is a view of metadata where every field was read at Version.
+// Cached is set when it was loaded from the last known good cache instead of
+// metadata. AllPeers counts the other hosts before the drained and unselected
+// ones were dropped, a delete guard tells an empty host list from peers
+// filtered out with it.
+type Snapshot struct {
+	Version    string               `json:"version"`
+	SelfHost   metadata.Host        `json:"selfHost"`
+	Hosts      []metadata.Host      `json:"hosts"`
+	Containers []metadata.Container `json:"containers"`
+	Networks   []metadata.Network   `json:"networks"`
+	Cached     bool                 `json:"-"`
+	AllPeers   int                  `json:"-"`
+}
+
+// Subsystem is something that converges local state to a metadata snapshot.
+type Subsystem interface {
+	Name() string
+	Reconcile(s *Snapshot) error
+}
+
+// Resyncer is implemented by subsystems that skip work in Reconcile when the
+// snapshot didn't change what they apply, and need to be told when a periodic
+// full resync is due instead.
+type Resyncer interface {
+	Resync(s *Snapshot) error
+}
+
+// Retrier is implemented by subsystems that track failed items in a
+// RetryQueue, the reconciler runs them again as soon as an item is due.
+type Retrier interface {
+	Retries() *RetryQueue
+}
+
+type Options struct {
+	// PollInterval is how often the metadata version is checked.
+	PollInterval time.Duration
+	// PollJitter adds up to this fraction of PollInterval to every poll.
+	PollJitter float64
+	// ResyncInterval forces a full reconcile of every subsystem even if the
+	// metadata version doesn't change, 0 disables it.
+	ResyncInterval time.Duration
+	// SubsystemResyncIntervals overrides ResyncInterval by subsystem name.
+	SubsystemResyncIntervals map[string]time.Duration
+	// RetryInitialBackoff and RetryMaxBackoff bound the delay between
+	// attempts on a failed item.
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+	// MaxDeleteFraction and DeleteConfirmVersions configure the DeleteGuard
+	// of every subsystem.
+	MaxDeleteFraction     float64
+	DeleteConfirmVersions int
+	// HostSelector picks the peers the subsystems see, the self host is
+	// always kept.
+	HostSelector selector.Selector
+	// DrainLabel is the host label draining a host when set to true.
+	DrainLabel string
+	// CacheFile persists the last known good snapshot, empty disables it.
+	CacheFile string
+	// State records the objects created by the subsystems.
+	State *state.Store
+}
+
+type subsystem struct {
+	Subsystem
+	resyncInterval time.Duration
+	lastSync       time.Time
+	lastError      error
+	reconciles     int64
+	failures       int64
+	itemFailures   map[string]int64
+}
+
+// Status is what the reconciler reports about itself and its subsystems.
+// Cached tells the subsystems run on the last known good snapshot because
+// metadata is unreachable.
+type Status struct {
+	Version       string            `json:"version"`
+	Cached        bool              `json:"cached"`
+	MetadataError string            `json:"metadataError,omitempty"`
+	Drained       bool              `json:"drained"`
+	Subsystems    []SubsystemStatus `json:"subsystems"`
+}
+
+type SubsystemStatus struct {
+	Name      string      `json:"name"`
+	LastSync  time.Time   `json:"lastSync"`
+	LastError string      `json:"lastError,omitempty"`
+	Errors    []ItemError `json:"errors,omitempty"`
+	Retries   []RetryItem `json:"retries,omitempty"`
+	// Reconciles and Failures count the passes since start, ItemFailures
+	// counts the failed items by operation.
+	Reconciles   int64            `json:"reconciles"`
+	Failures     int64            `json:"failures"`
+	ItemFailures map[string]int64 `json:"itemFailures,omitempty"`
+}
+
+// Reconciler polls metadata once and fans every new snapshot out to the
+// registered subsystems, in the order they were registered.
+type Reconciler struct {
+	sync.Mutex
+	m          metadata.Client
+	opts       Options
+	rand       *rand.Rand
+	version    string
+	last       *Snapshot
+	mdErr      error
+	subsystems []*subsystem
+	reload     chan struct{}
+	onReload   []func() error
+	queues     []*RetryQueue
+	guards     []*DeleteGuard
+	// selfDrained is set by the drain label of the self host, drainLogged
+	// is what was last logged.
+	selfDrained bool
+	drainLogged bool
+	// offline is set while the passes run on the last known good snapshot
+	// because metadata is unreachable.
+	offline bool
+}
+
+func New(m metadata.Client, opts Options) *Reconciler {
+	return &Reconciler{
+		m:      m,
+		opts:   opts,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		reload: make(chan struct{}, 1),
+	}
+}
+
+func (r *Reconciler) Register(s Subsystem) {
+	r.subsystems = append(r.subsystems, &subsystem{
+		Subsystem:      s,
+		resyncInterval: r.resyncInterval(s.Name()),
+		itemFailures:   map[string]int64{},
+	})
+}
+
+func (r *Reconciler) resyncInterval(name string) time.Duration {
+	if d, ok := r.opts.SubsystemResyncIntervals[name]; ok {
+		return d
+	}
+	return r.opts.ResyncInterval
+}
+
+// OnReload adds a function run by Reload before the full reconcile, on the
+// reconciler goroutine. An error is logged and doesn't stop the reconcile.
+func (r *Reconciler) OnReload(f func() error) {
+	r.onReload = append(r.onReload, f)
+}
+
+// SetOptions changes the intervals, backoffs and delete thresholds, including
+// those of the retry queues and delete guards already handed out. CacheFile
+// and State are kept. It's meant to be called from an OnReload function.
+func (r *Reconciler) SetOptions(opts Options) {
+	opts.CacheFile = r.opts.CacheFile
+	opts.State = r.opts.State
+	r.opts = opts
+	for _, sub := range r.subsystems {
+		sub.resyncInterval = r.resyncInterval(sub.Name())
+	}
+	for _, q := range r.queues {
+		q.SetBackoff(opts.RetryInitialBackoff, opts.RetryMaxBackoff)
+	}
+	for _, g := range r.guards {
+		g.SetThresholds(opts.MaxDeleteFraction, opts.DeleteConfirmVersions)
+	}
+}
+
+// NewRetryQueue returns a RetryQueue using the configured backoff.
+func (r *Reconciler) NewRetryQueue() *RetryQueue {
+	q := NewRetryQueue(r.opts.RetryInitialBackoff, r.opts.RetryMaxBackoff)
+	r.queues = append(r.queues, q)
+	return q
+}
+
+// NewDeleteGuard returns a DeleteGuard using the configured thresholds.
+func (r *Reconciler) NewDeleteGuard(name string) *DeleteGuard {
+	g := NewDeleteGuard(name, r.opts.MaxDeleteFraction, r.opts.DeleteConfirmVersions)
+	r.guards = append(r.guards, g)
+	return g
+}
+
+// Owner returns the part of the state store belonging to a subsystem.
+func (r *Reconciler) Owner(name string) *state.Owner {
+	return r.opts.State.Owner(name)
+}
+
+func (r *Reconciler) Status() Status {
+	r.Lock()
+	defer r.Unlock()
+	status := Status{}
+	if r.last != nil {
+		status.Version = r.last.Version
+	}
+	status.Cached = r.offline
+	if r.mdErr != nil {
+		status.MetadataError = r.mdErr.Error()
+	}
+	status.Drained = r.selfDrained
+	for _, sub := range r.subsystems {
+		ss := SubsystemStatus{
+			Name:         sub.Name(),
+			LastSync:     sub.lastSync,
+			Reconciles:   sub.reconciles,
+			Failures:     sub.failures,
+			ItemFailures: map[string]int64{},
+		}
+		for op, n := range sub.itemFailures {
+			ss.ItemFailures[op] = n
+		}
+		if sub.lastError != nil {
+			ss.LastError = sub.lastError.Error()
+			if m, ok := errors.Cause(sub.lastError).(*MultiError); ok {
+				ss.Errors = m.Items
+			}
+		}
+		if rt, ok := sub.Subsystem.(Retrier); ok {
+			ss.Retries = rt.Retries().Items()
+		}
+		status.Subsystems = append(status.Subsystems, ss)
+	}
+	return status
+}
+
+func (r *Reconciler) Start() {
+	go r.run()
+}
+
+// Reload asks for the OnReload functions to run, followed by a full reconcile
+// of every subsystem on fresh metadata, without waiting for the next poll.
+func (r *Reconciler) Reload() {
+	select {
+	case r.reload <- struct{}{}:
+	default:
+	}
+}
+
+func (r *Reconciler) run() {
+	force := false
+	for {
+		r.poll(force)
+		r.saveState()
+		select {
+		case <-time.After(r.nextPoll()):
+			force = false
+		case <-r.reload:
+			logrus.Info("Reloading, resyncing every subsystem")
+			for _, f := range r.onReload {
+				if err := f(); err != nil {
+					logrus.Errorf("Failed to reload: %v", err)
+				}
+			}
+			force = true
+		}
+	}
+}
+
+// saveState writes what the subsystems recorded during the pass, a failed
+// save is tried again after the next one.
+func (r *Reconciler) saveState() {
+	if err := r.opts.State.Save(); err != nil {
+		logrus.Errorf("Failed to save state: %v", err)
+	}
+}
+
+// nextPoll spreads the agents' polls so they don't hit metadata in lockstep.
+func (r *Reconciler) nextPoll() time.Duration {
+	d := r.opts.PollInterval
+	if r.opts.PollJitter > 0 {
+		d += time.Duration(r.rand.Float64() * r.opts.PollJitter * float64(r.opts.PollInterval))
+	}
+	return d
+}
+
+// poll reconciles the subsystems concerned by a new metadata version, a due
+// resync or a due retry. force resyncs all of them.
+func (r *Reconciler) poll(force bool) {
+	version, err := r.getVersion()
+	r.setMetadataError(err)
+	if err != nil {
+		logrus.Errorf("Error reading metadata version: %v", err)
+		r.pollOffline(force)
+		return
+	}
+	changed := version != r.version
+	if changed {
+		logrus.Debugf("Metadata version has been changed. Old version: %s. New version: %s.", r.version, version)
+	}
+
+	var s *Snapshot
+	if !changed && !force {
+		// Retries don't need fresh data, they redo what the last
+		// snapshot asked for.
+		s = r.last
+	}
+	for _, sub := range r.subsystems {
+		resync := force || (!changed && resyncDue(sub))
+		if !changed && !resync && !retryDue(sub) {
+			continue
+		}
+		if s == nil {
+			if s, err = r.snapshot(version); err != nil {
+				logrus.Errorf("Failed to get metadata snapshot: %v", err)
+				r.setMetadataError(err)
+				r.pollOffline(force)
+				return
+			}
+		}
+		r.reconcile(sub, s, resync)
+	}
+	r.setOffline(false)
+	if s == nil {
+		return
+	}
+	if changed && r.opts.CacheFile != "" {
+		if err := saveCache(r.opts.CacheFile, s); err != nil {
+			logrus.Errorf("Failed to save metadata cache: %v", err)
+		}
+	}
+	r.Lock()
+	r.version = s.Version
+	r.last = s
+	r.Unlock()
+}
+
+// pollOffline keeps enforcing the last known good snapshot while metadata is
+// unreachable, loading it from the cache when the agent just started.
+func (r *Reconciler) pollOffline(force bool) {
+	if r.last == nil {
+		if r.opts.CacheFile == "" {
+			return
+		}
+		s, savedAt, err := loadCache(r.opts.CacheFile)
+		if err != nil {
+			logrus.Errorf("Metadata is unreachable and no usable cache: %v", err)
+			return
+		}
+		logrus.Warnf("Metadata is unreachable, RUNNING ON CACHED metadata version %s saved at %s", s.Version, savedAt.Format(time.RFC3339))
+		r.Lock()
+		r.last = s
+		r.offline = true
+		r.Unlock()
+		for _, sub := range r.subsystems {
+			r.reconcile(sub, s, false)
+		}
+		return
+	}
+
+	r.setOffline(true)
+	for _, sub := range r.subsystems {
+		resync := force || resyncDue(sub)
+		if resync || retryDue(sub) {
+			r.reconcile(sub, r.last, resync)
+		}
+	}
+}
+
+// setOffline records whether the passes run on the last known good snapshot,
+// logging when that changes.
+func (r *Reconciler) setOffline(offline bool) {
+	r.Lock()
+	changed := offline != r.offline
+	r.offline = offline
+	version := r.version
+	r.Unlock()
+	if !changed {
+		return
+	}
+	if offline {
+		logrus.Warnf("Metadata is unreachable, RUNNING ON LAST KNOWN GOOD metadata version %s", version)
+	} else {
+		logrus.Info("Metadata is reachable again")
+	}
+}
+
+func (r *Reconciler) setMetadataError(err error) {
+	r.Lock()
+	r.mdErr = err
+	r.Unlock()
+}
+
+func resyncDue(sub *subsystem) bool {
+	return sub.resyncInterval > 0 && time.Since(sub.lastSync) >= sub.resyncInterval
+}
+
+func retryDue(sub *subsystem) bool {
+	rt, ok := sub.Subsystem.(Retrier)
+	return ok && rt.Retries().Due()
+}
+
+// reconcile runs a single subsystem, making sure neither an error nor a panic
+// stops the subsystems registered after it.
+func (r *Reconciler) reconcile(sub *subsystem, s *Snapshot, resync bool) {
+	if r.isDrained(s) {
+		return
+	}
+	var err error
+	defer func() {
+		if p := recover(); p != nil {
+			err = errors.Errorf("panic: %v", p)
+		}
+		r.record(sub, s, err)
+	}()
+
+	if rs, ok := sub.Subsystem.(Resyncer); ok && resync {
+		logrus.Debugf("%s: resyncing metadata version %s", sub.Name(), s.Version)
+		err = rs.Resync(r.selectHosts(s))
+	} else {
+		logrus.Debugf("%s: reconciling metadata version %s", sub.Name(), s.Version)
+		err = sub.Reconcile(r.selectHosts(s))
+	}
+}
+
+// selectHosts drops the drained peers and those not matching the host
+// selector. Snapshots are kept, and cached, unfiltered so a new selector
+// applies on reload.
+func (r *Reconciler) selectHosts(s *Snapshot) *Snapshot {
+	selected := *s
+	selected.Hosts = nil
+	selected.AllPeers = 0
+	for _, h := range s.Hosts {
+		if h.UUID != s.SelfHost.UUID {
+			selected.AllPeers++
+		}
+		if h.UUID == s.SelfHost.UUID || (r.opts.HostSelector.Matches(h.Labels) && !r.hasDrainLabel(h)) {
+			selected.Hosts = append(selected.Hosts, h)
+		}
+	}
+	return &selected
+}
+
+func (r *Reconciler) record(sub *subsystem, s *Snapshot, err error) {
+	m, _ := errors.Cause(err).(*MultiError)
+	if m != nil {
+		for _, e := range m.Items {
+			logrus.WithFields(logrus.Fields{
+				"subsystem": sub.Name(),
+				"op":        e.Op,
+				"item":      e.Item,
+			}).Errorf("Failed to reconcile item: %s", e.Reason)
+		}
+	} else if err != nil {
+		logrus.Errorf("%s: failed to reconcile metadata version %s: %v", sub.Name(), s.Version, err)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	sub.lastSync = time.Now()
+	sub.lastError = err
+	sub.reconciles++
+	if err != nil {
+		sub.failures++
+	}
+	if m != nil {
+		for _, e := range m.Items {
+			sub.itemFailures[e.Op]++
+		}
+	}
+}
+
+// snapshot reads everything the subsystems need and retries when metadata
+// moved to another version in the meantime.
+func (r *Reconciler) snapshot(version string) (*Snapshot, error) {
+	var err error
+	for i := 0; i < maxSnapshotAttempts; i++ {
+		s := &Snapshot{Version: version}
+		if s.SelfHost, err = r.m.GetSelfHost(); err != nil {
+			return nil, errors.Wrap(err, "Failed to get self host from metadata")
+		}
+		if s.Hosts, err = r.m.GetHosts(); err != nil {
+			return nil, errors.Wrap(err, "Failed to get all hosts from metadata")
+		}
+		if s.Containers, err = r.m.GetContainers(); err != nil {
+			return nil, errors.Wrap(err, "Failed to get containers from metadata")
+		}
+		if s.Networks, err = r.m.GetNetworks(); err != nil {
+			return nil, errors.Wrap(err, "Failed to get networks from metadata")
+		}
+
+		current, err := r.getVersion()
+		if err != nil {
+			return nil, err
+		}
+		if current == version {
+			return s, nil
+		}
+		logrus.Debugf("Metadata version changed from %s to %s while taking snapshot, retrying", version, current)
+		version = current
+	}
+	return nil, errors.Errorf("Metadata kept changing after %d attempts", maxSnapshotAttempts)
+}
+
+func (r *Reconciler) getVersion() (string, error) {
+	resp, err := r.m.SendRequest("/version")
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to get metadata version")
+	}
+	var version string
+	if err := json.Unmarshal(resp, &version); err != nil {
+		return "", errors.Wrap(err, "Failed to parse metadata version")
+	}
+	return version, nil
+}
@@ -0,0 +1,132 @@
+package reconcile
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// RetryItem is a single failed operation waiting for its next attempt.
+type RetryItem struct {
+	Op          string    `json:"op"`
+	Item        string    `json:"item"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError"`
+	NextAttempt time.Time `json:"nextAttempt"`
+}
+
+// RetryQueue tracks failed items of a subsystem and spaces their retries
+// with an exponential backoff. Items that succeed are never tracked.
+//
+// A reconcile pass asks Ready before touching an item, reports the outcome
+// with Done and finishes with Prune, which forgets the items the pass didn't
+// look at anymore.
+type RetryQueue struct {
+	sync.Mutex
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	items          map[retryKey]*RetryItem
+	seen           map[retryKey]bool
+}
+
+type retryKey struct {
+	op   string
+	item string
+}
+
+func NewRetryQueue(initialBackoff, maxBackoff time.Duration) *RetryQueue {
+	return &RetryQueue{
+		initialBackoff: initialBackoff,
+		maxBackoff:     maxBackoff,
+		items:          map[retryKey]*RetryItem{},
+		seen:           map[retryKey]bool{},
+	}
+}
+
+// SetBackoff changes the backoff of the next failures.
+func (q *RetryQueue) SetBackoff(initialBackoff, maxBackoff time.Duration) {
+	q.Lock()
+	defer q.Unlock()
+	q.initialBackoff = initialBackoff
+	q.maxBackoff = maxBackoff
+}
+
+// Ready reports whether op may be attempted on item now.
+func (q *RetryQueue) Ready(op, item string) bool {
+	key := retryKey{op, item}
+	q.Lock()
+	defer q.Unlock()
+	q.seen[key] = true
+	i, ok := q.items[key]
+	return !ok || !time.Now().Before(i.NextAttempt)
+}
+
+// Done records the outcome of op on item.
+func (q *RetryQueue) Done(op, item string, err error) {
+	key := retryKey{op, item}
+	q.Lock()
+	defer q.Unlock()
+	q.seen[key] = true
+	if err == nil {
+		delete(q.items, key)
+		return
+	}
+
+	i, ok := q.items[key]
+	if !ok {
+		i = &RetryItem{Op: op, Item: item}
+		q.items[key] = i
+	}
+	backoff := q.initialBackoff
+	for n := 0; n < i.Attempts && backoff < q.maxBackoff; n++ {
+		backoff *= 2
+	}
+	if backoff > q.maxBackoff {
+		backoff = q.maxBackoff
+	}
+	i.Attempts++
+	i.LastError = err.Error()
+	i.NextAttempt = time.Now().Add(backoff)
+}
+
+// Prune forgets the items that weren't looked at since the last Prune, they
+// are either fixed or not wanted anymore.
+func (q *RetryQueue) Prune() {
+	q.Lock()
+	defer q.Unlock()
+	for key := range q.items {
+		if !q.seen[key] {
+			delete(q.items, key)
+		}
+	}
+	q.seen = map[retryKey]bool{}
+}
+
+// Due reports whether any item is ready to be retried.
+func (q *RetryQueue) Due() bool {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	for _, i := range q.items {
+		if !now.Before(i.NextAttempt) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *RetryQueue) Items() []RetryItem {
+	q.Lock()
+	defer q.Unlock()
+	items := make([]RetryItem, 0, len(q.items))
+	for _, i := range q.items {
+		items = append(items, *i)
+	}
+	sort.Slice(items, func(a, b int) bool {
+		if items[a].Item != items[b].Item {
+			return items[a].Item < items[b].Item
+		}
+		return items[a].Op < items[b].Op
+	})
+	return items
+}
@@ -0,0 +1,87 @@
+package reconcile
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	q := NewRetryQueue(time.Second, 10*time.Second)
+	want := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		10 * time.Second,
+		10 * time.Second,
+	}
+	for n, backoff := range want {
+		before := time.Now()
+		q.Done("add", "a", errors.New("failed"))
+		items := q.Items()
+		if len(items) != 1 {
+			t.Fatalf("attempt %d: got %d items, want 1", n+1, len(items))
+		}
+		if items[0].Attempts != n+1 {
+			t.Errorf("attempt %d: got %d attempts", n+1, items[0].Attempts)
+		}
+		got := items[0].NextAttempt.Sub(before)
+		if got < backoff || got > backoff+time.Second {
+			t.Errorf("attempt %d: got backoff %v, want %v", n+1, got, backoff)
+		}
+		if q.Ready("add", "a") {
+			t.Errorf("attempt %d: ready before its backoff", n+1)
+		}
+	}
+}
+
+func TestRetryDone(t *testing.T) {
+	q := NewRetryQueue(time.Hour, time.Hour)
+	if !q.Ready("add", "a") {
+		t.Error("unknown item not ready")
+	}
+	q.Done("add", "a", errors.New("failed"))
+	if q.Ready("add", "a") || q.Due() {
+		t.Error("failed item ready before its backoff")
+	}
+	if !q.Ready("del", "a") {
+		t.Error("other op on the failed item not ready")
+	}
+	q.Done("add", "a", nil)
+	if !q.Ready("add", "a") || len(q.Items()) != 0 {
+		t.Error("succeeded item still tracked")
+	}
+}
+
+func TestRetryPrune(t *testing.T) {
+	q := NewRetryQueue(time.Hour, time.Hour)
+	q.Done("add", "a", errors.New("failed"))
+	q.Done("add", "b", errors.New("failed"))
+	q.Prune()
+	if len(q.Items()) != 2 {
+		t.Fatalf("got %d items after the failing pass, want 2", len(q.Items()))
+	}
+
+	// Only a is still wanted.
+	q.Ready("add", "a")
+	q.Prune()
+	items := q.Items()
+	if len(items) != 1 || items[0].Item != "a" {
+		t.Fatalf("got %v after pruning, want a alone", items)
+	}
+
+	q.Prune()
+	if len(q.Items()) != 0 {
+		t.Errorf("got %v after a pass not looking at a", q.Items())
+	}
+}
+
+func TestRetryDue(t *testing.T) {
+	q := NewRetryQueue(time.Nanosecond, time.Nanosecond)
+	q.Done("add", "a", errors.New("failed"))
+	time.Sleep(time.Millisecond)
+	if !q.Due() || !q.Ready("add", "a") {
+		t.Error("item not due after its backoff")
+	}
+}
@@ -2,4 +2,26 @@
 
 package register
 
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
 func Init(register, unregister bool) error { return nil }
+
+// ReloadSignal fires on SIGHUP.
+func ReloadSignal() <-chan struct{} {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	rtn := make(chan struct{}, 1)
+	go func() {
+		for range c {
+			select {
+			case rtn <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return rtn
+}
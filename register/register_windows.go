@@ -48,6 +48,7 @@ var (
 	oldStderr     syscall.Handle
 	panicFile     *os.File
 	serviceSignal = make(chan bool)
+	reloadSignal  = make(chan struct{}, 1)
 )
 
 type handler struct {
@@ -354,6 +355,10 @@ Loop:
 		case c := <-r:
 			switch c.Cmd {
 			case svc.Cmd(windows.SERVICE_CONTROL_PARAMCHANGE):
+				select {
+				case reloadSignal <- struct{}{}:
+				default:
+				}
 			case svc.Interrogate:
 				s <- c.CurrentStatus
 			case svc.Stop, svc.Shutdown:
@@ -446,6 +451,12 @@ func NotifyShutdown(err error) {
 	}
 }
 
+// ReloadSignal fires when the service is sent a PARAMCHANGE control, e.g.
+// with "sc.exe control rancher-per-host-subnet paramchange".
+func ReloadSignal() <-chan struct{} {
+	return reloadSignal
+}
+
 func Init(register, unregister bool) error {
 	if err := initService(register, unregister); err != nil {
 		return err
@@ -0,0 +1,96 @@
+package routeupdate
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/per-host-subnet/reconcile"
+	"github.com/rancher/per-host-subnet/selector"
+)
+
+// Rule chains a provider: every peer is routed by the first provider, in
+// chain order, whose selector matches the peer labels.
+type Rule struct {
+	Provider string
+	Selector selector.Selector
+	Options  Options
+}
+
+// selected hands its provider snapshots holding only the peers it routes.
+type selected struct {
+	RouteUpdate
+	rules   []Rule
+	index   int
+	retries *reconcile.RetryQueue
+}
+
+// RunChain creates the providers of the chain and registers them with the
+// reconciler, in chain order.
+func RunChain(rules []Rule, r *reconcile.Reconciler) ([]RouteUpdate, error) {
+	seen := map[string]bool{}
+	for _, rule := range rules {
+		if err := Validate(rule.Provider); err != nil {
+			return nil, err
+		}
+		if seen[rule.Provider] {
+			return nil, errors.Errorf("Route update provider %s is chained twice", rule.Provider)
+		}
+		seen[rule.Provider] = true
+	}
+
+	var rtn []RouteUpdate
+	for i, rule := range rules {
+		p, _ := Lookup(rule.Provider)
+		u, err := p.Factory(rule.Options, r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create route update provider %s", rule.Provider)
+		}
+		s := &selected{
+			RouteUpdate: u,
+			rules:       rules,
+			index:       i,
+			retries:     r.NewRetryQueue(),
+		}
+		r.Register(s)
+		rtn = append(rtn, s)
+	}
+	return rtn, nil
+}
+
+func (s *selected) Reconcile(snapshot *reconcile.Snapshot) error {
+	return s.RouteUpdate.Reconcile(s.filter(snapshot))
+}
+
+func (s *selected) Resync(snapshot *reconcile.Snapshot) error {
+	if rs, ok := s.RouteUpdate.(reconcile.Resyncer); ok {
+		return rs.Resync(s.filter(snapshot))
+	}
+	return s.RouteUpdate.Reconcile(s.filter(snapshot))
+}
+
+// Retries returns an empty queue for providers that don't retry items.
+func (s *selected) Retries() *reconcile.RetryQueue {
+	if rt, ok := s.RouteUpdate.(reconcile.Retrier); ok {
+		return rt.Retries()
+	}
+	return s.retries
+}
+
+func (s *selected) filter(snapshot *reconcile.Snapshot) *reconcile.Snapshot {
+	filtered := *snapshot
+	filtered.Hosts = nil
+	for _, h := range snapshot.Hosts {
+		if h.UUID == snapshot.SelfHost.UUID || s.owns(h) {
+			filtered.Hosts = append(filtered.Hosts, h)
+		}
+	}
+	return &filtered
+}
+
+func (s *selected) owns(h metadata.Host) bool {
+	for i, rule := range s.rules {
+		if rule.Selector.Matches(h.Labels) {
+			return i == s.index
+		}
+	}
+	return false
+}
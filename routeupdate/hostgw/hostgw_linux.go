@@ -4,65 +4,64 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/per-host-subnet/reconcile"
+	"github.com/rancher/per-host-subnet/state"
 )
 
 const (
 	ProviderName = "hostgw"
-
-	changeCheckInterval = 5
-	perHostSubnetLabel  = "io.rancher.network.per_host_subnet.subnet"
 )
 
 type HostGw struct {
-	m metadata.Client
+	s       *reconcile.Snapshot
+	retries *reconcile.RetryQueue
+	guard   *reconcile.DeleteGuard
+	owner   *state.Owner
 }
 
-func New(m metadata.Client) (*HostGw, error) {
+func New(retries *reconcile.RetryQueue, guard *reconcile.DeleteGuard, owner *state.Owner) (*HostGw, error) {
 	o := &HostGw{
-		m: m,
+		retries: retries,
+		guard:   guard,
+		owner:   owner,
 	}
 	return o, nil
 }
 
-func (p *HostGw) Start() {
-	go p.m.OnChange(changeCheckInterval, p.onChangeNoError)
+func (p *HostGw) Name() string {
+	return ProviderName
 }
 
-func (p *HostGw) onChangeNoError(version string) {
-	if err := p.Reload(); err != nil {
-		logrus.Errorf("Failed to apply host route : %v", err)
-	}
+func (p *HostGw) Retries() *reconcile.RetryQueue {
+	return p.retries
+}
+
+func (p *HostGw) Reconcile(s *reconcile.Snapshot) error {
+	p.s = s
+	return p.Reload()
 }
 
 func (p *HostGw) Reload() error {
 	logrus.Debug("HostGW: reload")
-	if err := p.configure(); err != nil {
+	if p.s == nil {
+		return nil
+	}
+	if err := p.configure(p.s.Version, p.s.SelfHost, p.s.Hosts, p.s.AllPeers == 0); err != nil {
 		return errors.Wrap(err, "Failed to reload hostgw routes")
 	}
 	return nil
 }
 
-func (p *HostGw) configure() error {
-	logrus.Debug("HostGW: reload")
-
-	selfHost, err := p.m.GetSelfHost()
-	if err != nil {
-		return errors.Wrap(err, "Failed to get self host from metadata")
-	}
-	allHosts, err := p.m.GetHosts()
+func (p *HostGw) configure(version string, selfHost metadata.Host, allHosts []metadata.Host, noPeers bool) error {
+	desiredRoutes, err := getDesiredRouteEntries(selfHost, allHosts)
 	if err != nil {
-		return errors.Wrap(err, "Failed to get all hosts from metadata")
+		return errors.Wrap(err, "Failed to getDesiredRouteEntries")
 	}
-
-	currentRoutes, err := getCurrentRouteEntries(selfHost)
+	currentRoutes, err := getCurrentRouteEntries(selfHost, desiredRoutes, p.owner)
 	if err != nil {
 		return errors.Wrap(err, "Failed to getCurrentRouteEntries")
 	}
-	desiredRoutes, err := getDesiredRouteEntries(selfHost, allHosts)
-	if err != nil {
-		return errors.Wrap(err, "Failed to getDesiredRouteEntries")
-	}
-	err = updateRoutes(currentRoutes, desiredRoutes)
+	err = updateRoutes(version, currentRoutes, desiredRoutes, noPeers, p.retries, p.guard, p.owner)
 	if err != nil {
 		return errors.Wrap(err, "Failed to updateRoutes")
 	}
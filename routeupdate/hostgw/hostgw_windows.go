@@ -7,70 +7,72 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/per-host-subnet/reconcile"
+	"github.com/rancher/per-host-subnet/setting"
+	"github.com/rancher/per-host-subnet/state"
 	winroute "github.com/rancher/win-route-netsh"
 )
 
 const (
 	ProviderName = "hostgw"
 
-	changeCheckInterval = 5
-	perHostSubnetLabel  = "io.rancher.network.per_host_subnet.subnet"
-	routerIPLabel       = "io.rancher.network.per_host_subnet.router_ip"
+	routeKind = "route"
 )
 
 type HostGw struct {
-	m metadata.Client
-	r winroute.IRouter
+	r       winroute.IRouter
+	s       *reconcile.Snapshot
+	retries *reconcile.RetryQueue
+	guard   *reconcile.DeleteGuard
+	owner   *state.Owner
 }
 
-func New(m metadata.Client) (*HostGw, error) {
+func New(retries *reconcile.RetryQueue, guard *reconcile.DeleteGuard, owner *state.Owner) (*HostGw, error) {
 	o := &HostGw{
-		m: m,
-		r: winroute.New(),
+		r:       winroute.New(),
+		retries: retries,
+		guard:   guard,
+		owner:   owner,
 	}
 	return o, nil
 }
 
-func (p *HostGw) Start() {
-	go p.m.OnChange(changeCheckInterval, p.onChangeNoError)
+// TODO p.r.Close() when a stop signal is received
+
+func (p *HostGw) Name() string {
+	return ProviderName
 }
 
-// TODO p.r.Close() when a stop signal is received
+func (p *HostGw) Retries() *reconcile.RetryQueue {
+	return p.retries
+}
 
-func (p *HostGw) onChangeNoError(version string) {
-	if err := p.Reload(); err != nil {
-		log.Errorf("Failed to apply host route : %v", err)
-	}
+func (p *HostGw) Reconcile(s *reconcile.Snapshot) error {
+	p.s = s
+	return p.Reload()
 }
 
 func (p *HostGw) Reload() error {
 	log.Debug("HostGW: reload")
-	if err := p.configure(); err != nil {
+	if p.s == nil {
+		return nil
+	}
+	if err := p.configure(p.s.Version, p.s.SelfHost, p.s.Hosts, p.s.AllPeers == 0); err != nil {
 		return errors.Wrap(err, "Failed to reload hostgw routes")
 	}
 	return nil
 }
 
-func (p *HostGw) configure() error {
-	log.Debug("HostGW: reload")
-
-	selfHost, err := p.m.GetSelfHost()
-	if err != nil {
-		return errors.Wrap(err, "Failed to get self host from metadata")
-	}
-	allHosts, err := p.m.GetHosts()
-	if err != nil {
-		return errors.Wrap(err, "Failed to get all hosts from metadata")
-	}
-	_, ipNet, err := net.ParseCIDR(selfHost.Labels[perHostSubnetLabel])
+func (p *HostGw) configure(version string, selfHost metadata.Host, allHosts []metadata.Host, noPeers bool) error {
+	_, ipNet, err := net.ParseCIDR(selfHost.Labels[setting.SubnetLabel])
 	if err != nil {
 		return errors.Wrapf(err, "Selfhost subnet configuration error")
 	}
 
-	routerIpAddress, ok := selfHost.Labels[routerIPLabel]
+	routerIpAddress, ok := selfHost.Labels[setting.RouterIPLabel]
 	if !ok {
-		log.Warnf("this host %s don't have lable $s, skip this host", selfHost.UUID, routerIPLabel)
-		return fmt.Errorf("this host %s don't have lable $s, skip this host", selfHost.UUID, routerIPLabel)
+		log.Warnf("this host %s don't have lable $s, skip this host", selfHost.UUID, setting.RouterIPLabel)
+		return fmt.Errorf("this host %s don't have lable $s, skip this host", selfHost.UUID, setting.RouterIPLabel)
 	}
 	// interface indeces aren't static, do a lookup each pass
 	Is, err := getInterfaceFromAddress(routerIpAddress)
@@ -82,15 +84,15 @@ func (p *HostGw) configure() error {
 		return errors.New("")
 	}
 
-	currentRoutes, err := p.getCurrentRouteEntries(Is[0], selfHost, ipNet)
-	if err != nil {
-		return errors.Wrap(err, "Failed to getCurrentRouteEntries")
-	}
 	desiredRoutes, err := p.getDesiredRouteEntries(Is[0], selfHost, allHosts)
 	if err != nil {
 		return errors.Wrap(err, "Failed to getDesiredRouteEntries")
 	}
-	err = p.updateRoutes(currentRoutes, desiredRoutes)
+	currentRoutes, err := p.getCurrentRouteEntries(Is[0], selfHost, ipNet, desiredRoutes)
+	if err != nil {
+		return errors.Wrap(err, "Failed to getCurrentRouteEntries")
+	}
+	err = p.updateRoutes(version, currentRoutes, desiredRoutes, noPeers)
 	if err != nil {
 		return errors.Wrap(err, "Failed to updateRoutes")
 	}
@@ -0,0 +1,18 @@
+package hostgw
+
+import (
+	"github.com/pkg/errors"
+	"github.com/rancher/per-host-subnet/reconcile"
+	"github.com/rancher/per-host-subnet/routeupdate"
+)
+
+func init() {
+	routeupdate.Register(ProviderName, "Route every peer subnet through the peer itself, hosts must share a L2 segment", newProvider)
+}
+
+func newProvider(opts routeupdate.Options, r *reconcile.Reconciler) (routeupdate.RouteUpdate, error) {
+	for k := range opts {
+		return nil, errors.Errorf("Unknown option %s", k)
+	}
+	return New(r.NewRetryQueue(), r.NewDeleteGuard(ProviderName), r.Owner(ProviderName))
+}
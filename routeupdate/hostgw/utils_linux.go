@@ -2,38 +2,84 @@ package hostgw
 
 import (
 	"net"
+	"syscall"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/per-host-subnet/reconcile"
+	"github.com/rancher/per-host-subnet/routeupdate"
+	"github.com/rancher/per-host-subnet/setting"
+	"github.com/rancher/per-host-subnet/state"
 	"github.com/vishvananda/netlink"
 )
 
 const (
-	agentIPLabel = "io.rancher.network.per_host_subnet.override_agent_ip"
+	routeKind = "route"
 )
 
 func getHostSubnet(host metadata.Host) (*net.IPNet, error) {
-	ipnet, err := netlink.ParseIPNet(host.Labels[perHostSubnetLabel])
+	ipnet, err := netlink.ParseIPNet(host.Labels[setting.SubnetLabel])
 	if err != nil {
-		logrus.Errorf("Failed to parse host %s subnet: %s", host.Name, err)
+		logrus.Warnf("Failed to parse host %s subnet, skipping it: %s", host.Name, err)
 	}
 	return ipnet, err
 }
 
-func getCurrentRouteEntries(host metadata.Host) (map[string]*netlink.Route, error) {
-	routeFilter := &netlink.Route{Src: net.ParseIP(getAgentIP(host))}
-	existRoutes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, routeFilter, netlink.RT_FILTER_SRC)
+// routeRecord is how a route created by hostgw is kept in the state store.
+type routeRecord struct {
+	Dst string `json:"dst"`
+	Gw  string `json:"gw"`
+	Src string `json:"src"`
+}
+
+// getCurrentRouteEntries returns the routes hostgw is responsible for: the ones
+// using the agent IP as source and the ones recorded in the state store, which
+// catch routes left with a stale source or gateway after an agent IP or
+// override label change. Gateway routes to a peer subnet are adopted, and
+// recorded, only while the store has no record of hostgw at all, as they may
+// predate it.
+func getCurrentRouteEntries(host metadata.Host, desired map[string]*netlink.Route, owner *state.Owner) (map[string]*netlink.Route, error) {
+	existRoutes, err := netlink.RouteList(nil, netlink.FAMILY_V4)
 	if err != nil {
 		logrus.Errorf("Failed to getCurrentRouteEntries, RouteList: %v", err)
 		return nil, err
 	}
 
+	owned := map[string]bool{}
+	for _, key := range owner.Keys(routeKind) {
+		owned[key] = true
+	}
+
+	peerSubnets := map[string]bool{}
+	for _, r := range desired {
+		peerSubnets[r.Dst.String()] = true
+	}
+
+	adopt := !owner.Known()
+	agentIP := net.ParseIP(routeupdate.AgentIP(host))
 	routeEntries := make(map[string]*netlink.Route)
 	for index, r := range existRoutes {
-		if !r.Dst.Contains(net.ParseIP(getAgentIP(host))) {
-			gwIP := r.Gw.String()
-			routeEntries[gwIP] = &existRoutes[index]
+		if r.Dst == nil || r.Gw == nil {
+			continue
+		}
+		key := routeKey(&r)
+		if owned[key] || (r.Src.Equal(agentIP) && !r.Dst.Contains(agentIP)) {
+			routeEntries[key] = &existRoutes[index]
+			delete(owned, key)
+		} else if adopt && peerSubnets[r.Dst.String()] {
+			routeEntries[key] = &existRoutes[index]
+			if err := owner.Add(routeKind, key, newRouteRecord(&r)); err != nil {
+				logrus.Errorf("Failed to adopt route %s: %v", key, err)
+			}
+		}
+	}
+	if err := owner.Init(); err != nil {
+		logrus.Errorf("Failed to initialize route records: %v", err)
+	}
+	// Records left are routes that were removed behind our back
+	for key := range owned {
+		if err := owner.Remove(routeKind, key); err != nil {
+			logrus.Errorf("Failed to forget route %s: %v", key, err)
 		}
 	}
 
@@ -46,16 +92,23 @@ func getDesiredRouteEntries(selfHost metadata.Host, allHosts []metadata.Host) (m
 
 	for _, h := range allHosts {
 		if h.UUID != selfHost.UUID {
+			// A host missing its labels is skipped, not failing the
+			// routes to every other host.
 			dst, err := getHostSubnet(h)
 			if err != nil {
-				return nil, err
+				continue
+			}
+			gw := net.ParseIP(routeupdate.AgentIP(h))
+			if gw == nil {
+				logrus.Warnf("Invalid agent IP %q on host %s, skipping it", routeupdate.AgentIP(h), h.Name)
+				continue
 			}
 			r := &netlink.Route{
 				Dst: dst,
-				Src: net.ParseIP(getAgentIP(selfHost)),
-				Gw:  net.ParseIP(getAgentIP(h)),
+				Src: net.ParseIP(routeupdate.AgentIP(selfHost)),
+				Gw:  gw,
 			}
-			routeEntries[getAgentIP(h)] = r
+			routeEntries[routeKey(r)] = r
 		}
 	}
 
@@ -63,36 +116,80 @@ func getDesiredRouteEntries(selfHost metadata.Host, allHosts []metadata.Host) (m
 	return routeEntries, nil
 }
 
-func updateRoutes(oldEntries map[string]*netlink.Route, newEntries map[string]*netlink.Route) error {
-	var e error
+func updateRoutes(version string, oldEntries map[string]*netlink.Route, newEntries map[string]*netlink.Route, noPeers bool, retries *reconcile.RetryQueue, guard *reconcile.DeleteGuard, owner *state.Owner) error {
+	var e reconcile.MultiError
+	defer retries.Prune()
+
+	desiredSubnets := map[string]bool{}
+	for _, ne := range newEntries {
+		desiredSubnets[ne.Dst.String()] = true
+	}
 
-	for ip, oe := range oldEntries {
-		_, ok := newEntries[ip]
+	var toDelEntries []*netlink.Route
+	removed := 0
+	for key, oe := range oldEntries {
+		_, ok := newEntries[key]
 		if ok {
-			delete(newEntries, ip)
+			delete(newEntries, key)
+			// Adopt routes created before the state store existed
+			if !owner.Has(routeKind, key) {
+				e.Add("record route", key, owner.Add(routeKind, key, newRouteRecord(oe)))
+			}
 		} else {
-			err := netlink.RouteDel(oe)
-			if err != nil {
-				logrus.Errorf("updateRoute: failed to RouteDel, %v", err)
-				e = errors.Wrap(e, err.Error())
+			toDelEntries = append(toDelEntries, oe)
+			if !desiredSubnets[oe.Dst.String()] {
+				removed++
 			}
 		}
 	}
 
-	for _, ne := range newEntries {
+	// Routes with a stale source or gateway are replaced rather than
+	// removed, only the others count as a deletion for the guard.
+	if !guard.Allow(version, len(oldEntries), removed, noPeers) {
+		var replaced []*netlink.Route
+		for _, oe := range toDelEntries {
+			if desiredSubnets[oe.Dst.String()] {
+				replaced = append(replaced, oe)
+			}
+		}
+		toDelEntries = replaced
+	}
+	for _, oe := range toDelEntries {
+		key := routeKey(oe)
+		if !retries.Ready("del route", key) {
+			continue
+		}
+		err := netlink.RouteDel(oe)
+		if err == nil || err == syscall.ESRCH {
+			err = owner.Remove(routeKind, key)
+		}
+		retries.Done("del route", key, err)
+		e.Add("del route", key, err)
+	}
+
+	for key, ne := range newEntries {
+		if !retries.Ready("add route", key) {
+			continue
+		}
 		err := netlink.RouteAdd(ne)
-		if err != nil {
-			logrus.Errorf("updateRoute: failed to RouteAdd, %v", err)
-			e = errors.Wrap(e, err.Error())
+		if err == nil {
+			err = owner.Add(routeKind, key, newRouteRecord(ne))
 		}
+		retries.Done("add route", key, err)
+		e.Add("add route", key, err)
 	}
 
-	return e
+	return e.ErrorOrNil()
 }
 
-func getAgentIP(host metadata.Host) string {
-	if v, ok := host.Labels[agentIPLabel]; ok {
-		return v
+func newRouteRecord(r *netlink.Route) routeRecord {
+	return routeRecord{
+		Dst: r.Dst.String(),
+		Gw:  r.Gw.String(),
+		Src: r.Src.String(),
 	}
-	return host.AgentIP
+}
+
+func routeKey(r *netlink.Route) string {
+	return r.Dst.String() + " via " + r.Gw.String() + " src " + r.Src.String()
 }
@@ -1,23 +1,52 @@
 package hostgw
 
 import (
+	"fmt"
 	"net"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/rancher/per-host-subnet/reconcile"
+	"github.com/rancher/per-host-subnet/setting"
 	winroute "github.com/rancher/win-route-netsh"
 )
 
-func (p *HostGw) getCurrentRouteEntries(iface net.Interface, host metadata.Host, subnet *net.IPNet) (map[string]*winroute.RouteRow, error) {
+// getCurrentRouteEntries returns the gateway routes on the router interface,
+// plus the ones recorded in the state store, which catch routes left on a
+// previous interface or with a stale next hop after a router IP change.
+// Gateway routes to a peer subnet are adopted, and recorded, only while the
+// store has no record of hostgw at all, as they may predate it.
+func (p *HostGw) getCurrentRouteEntries(iface net.Interface, host metadata.Host, subnet *net.IPNet, desired map[string]*winroute.RouteRow) (map[string]*winroute.RouteRow, error) {
 	routes, err := p.r.GetRoutes()
 	if err != nil {
 		return nil, err
 	}
-	routerIpAddress := host.Labels[routerIPLabel]
+	routerIpAddress := host.Labels[setting.RouterIPLabel]
+	owned := map[string]bool{}
+	for _, key := range p.owner.Keys(routeKind) {
+		owned[key] = true
+	}
+	peerSubnets := map[string]bool{}
+	for _, r := range desired {
+		peerSubnets[r.DestinationPrefix.String()] = true
+	}
+	adopt := !p.owner.Known()
 	routeEntries := make(map[string]*winroute.RouteRow)
 	for _, route := range routes {
+		key := routeKey(route)
+		if owned[key] {
+			routeEntries[key] = route
+			delete(owned, key)
+			continue
+		}
+		if adopt && peerSubnets[route.DestinationPrefix.String()] && !route.NextHop.Equal(net.ParseIP("0.0.0.0")) {
+			routeEntries[key] = route
+			if err := p.owner.Add(routeKind, key, newRouteRecord(route)); err != nil {
+				log.Errorf("Failed to adopt route %s: %v", key, err)
+			}
+			continue
+		}
 		// Skip routes on other interfaces
 		if uint64(iface.Index) != route.InterfaceIndex {
 			continue
@@ -35,8 +64,16 @@ func (p *HostGw) getCurrentRouteEntries(iface net.Interface, host metadata.Host,
 			continue
 		}
 
-		gwIP := route.NextHop.String()
-		routeEntries[gwIP] = route
+		routeEntries[key] = route
+	}
+	// Records left are routes that were removed behind our back
+	for key := range owned {
+		if err := p.owner.Remove(routeKind, key); err != nil {
+			log.Errorf("Failed to forget route %s: %v", key, err)
+		}
+	}
+	if err := p.owner.Init(); err != nil {
+		log.Errorf("Failed to initialize route records: %v", err)
 	}
 
 	p.logRouteEntries(routeEntries, "getCurrentRouteEntries")
@@ -52,15 +89,15 @@ func (p *HostGw) getDesiredRouteEntries(iface net.Interface, selfHost metadata.H
 			continue
 		}
 
-		_, ipNet, err := net.ParseCIDR(h.Labels[perHostSubnetLabel])
+		_, ipNet, err := net.ParseCIDR(h.Labels[setting.SubnetLabel])
 		if err != nil {
 			log.WithField("host", h.UUID).Warn(err)
 			continue
 		}
 
-		privateNetworkIp, ok := h.Labels[routerIPLabel]
+		privateNetworkIp, ok := h.Labels[setting.RouterIPLabel]
 		if !ok {
-			log.Warnf("host %s don't have lable $s, skip this host", h.UUID, routerIPLabel)
+			log.Warnf("host %s don't have lable $s, skip this host", h.UUID, setting.RouterIPLabel)
 			continue
 		}
 
@@ -69,39 +106,104 @@ func (p *HostGw) getDesiredRouteEntries(iface net.Interface, selfHost metadata.H
 			InterfaceIndex:    uint64(iface.Index),
 			NextHop:           net.ParseIP(privateNetworkIp),
 		}
-		routeEntries[h.AgentIP] = &r
+		routeEntries[routeKey(&r)] = &r
 	}
 
 	p.logRouteEntries(routeEntries, "getDesiredRouteEntries")
 	return routeEntries, nil
 }
 
-func (p *HostGw) updateRoutes(oldEntries map[string]*winroute.RouteRow, newEntries map[string]*winroute.RouteRow) error {
-	var e error
+func (p *HostGw) updateRoutes(version string, oldEntries map[string]*winroute.RouteRow, newEntries map[string]*winroute.RouteRow, noPeers bool) error {
+	var e reconcile.MultiError
+	defer p.retries.Prune()
 
-	for ip, oe := range oldEntries {
-		ne, ok := newEntries[ip]
+	desiredSubnets := map[string]bool{}
+	for _, ne := range newEntries {
+		desiredSubnets[ne.DestinationPrefix.String()] = true
+	}
+
+	var toDelEntries []*winroute.RouteRow
+	removed := 0
+	for key, oe := range oldEntries {
+		ne, ok := newEntries[key]
 
 		if ok && oe.Equal(ne) {
-			delete(newEntries, ip)
+			delete(newEntries, key)
+			// Adopt routes created before the state store existed
+			if !p.owner.Has(routeKind, key) {
+				e.Add("record route", key, p.owner.Add(routeKind, key, newRouteRecord(oe)))
+			}
 		} else {
-			err := p.r.DeleteRouteByDest(oe.DestinationPrefix.String())
-			if err != nil {
-				log.Errorf("updateRoute: failed to DeleteRoute, %v", err)
-				e = errors.Wrap(e, err.Error())
+			toDelEntries = append(toDelEntries, oe)
+			if !desiredSubnets[oe.DestinationPrefix.String()] {
+				removed++
 			}
 		}
 	}
 
-	for _, ne := range newEntries {
+	// Routes with a stale next hop or interface are replaced rather than
+	// removed, only the others count as a deletion for the guard.
+	if !p.guard.Allow(version, len(oldEntries), removed, noPeers) {
+		var replaced []*winroute.RouteRow
+		for _, oe := range toDelEntries {
+			if desiredSubnets[oe.DestinationPrefix.String()] {
+				replaced = append(replaced, oe)
+			}
+		}
+		toDelEntries = replaced
+	}
+	for _, oe := range toDelEntries {
+		key := routeKey(oe)
+		if !p.retries.Ready("del route", key) {
+			continue
+		}
+		err := p.deleteRoute(oe)
+		if err == nil {
+			err = p.owner.Remove(routeKind, key)
+		}
+		p.retries.Done("del route", key, err)
+		e.Add("del route", key, err)
+	}
+
+	for key, ne := range newEntries {
+		if !p.retries.Ready("add route", key) {
+			continue
+		}
 		err := p.r.AddRoute(ne)
-		if err != nil {
-			log.Errorf("updateRoute: failed to AddRoute, %v", err)
-			e = errors.Wrap(e, err.Error())
+		if err == nil {
+			err = p.owner.Add(routeKind, key, newRouteRecord(ne))
 		}
+		p.retries.Done("add route", key, err)
+		e.Add("add route", key, err)
 	}
 
-	return e
+	return e.ErrorOrNil()
+}
+
+// deleteRoute removes row alone. DeleteRouteByDest passes its argument to
+// get-netroute, narrowed down to the next hop and interface it doesn't remove
+// the desired route to the same destination along with a stale one.
+func (p *HostGw) deleteRoute(row *winroute.RouteRow) error {
+	return p.r.DeleteRouteByDest(fmt.Sprintf("-DestinationPrefix %s -NextHop %s -InterfaceIndex %d", row.DestinationPrefix, row.NextHop, row.InterfaceIndex))
+}
+
+// routeRecord is how a route created by hostgw is kept in the state store.
+type routeRecord struct {
+	Dst            string `json:"dst"`
+	NextHop        string `json:"nextHop"`
+	InterfaceIndex uint64 `json:"interfaceIndex"`
+}
+
+func newRouteRecord(r *winroute.RouteRow) routeRecord {
+	return routeRecord{
+		Dst:            r.DestinationPrefix.String(),
+		NextHop:        r.NextHop.String(),
+		InterfaceIndex: r.InterfaceIndex,
+	}
+}
+
+func routeKey(r *winroute.RouteRow) string {
+	return r.DestinationPrefix.String() + " via " + r.NextHop.String()
 }
 
 func (p *HostGw) logRouteEntries(entries map[string]*winroute.RouteRow, action string) {
@@ -0,0 +1,94 @@
+// Package routefile exports the routes to the peer subnets to a file, for an
+// external routing daemon to pick up, instead of installing them.
+package routefile
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/per-host-subnet/reconcile"
+	"github.com/rancher/per-host-subnet/routeupdate"
+	"github.com/rancher/per-host-subnet/setting"
+	"github.com/rancher/per-host-subnet/state"
+)
+
+const (
+	ProviderName = "routefile"
+
+	pathOption = "path"
+)
+
+func init() {
+	routeupdate.Register(ProviderName, "Write \"subnet via agent-ip\" lines to the file set by the path option", newProvider)
+}
+
+type RouteFile struct {
+	path string
+	s    *reconcile.Snapshot
+}
+
+func newProvider(opts routeupdate.Options, r *reconcile.Reconciler) (routeupdate.RouteUpdate, error) {
+	p := &RouteFile{}
+	for k, v := range opts {
+		switch k {
+		case pathOption:
+			p.path = v
+		default:
+			return nil, errors.Errorf("Unknown option %s", k)
+		}
+	}
+	if p.path == "" {
+		return nil, errors.Errorf("Option %s is required", pathOption)
+	}
+	return p, nil
+}
+
+func (p *RouteFile) Name() string {
+	return ProviderName
+}
+
+func (p *RouteFile) Reconcile(s *reconcile.Snapshot) error {
+	p.s = s
+	return p.Reload()
+}
+
+// Reload rewrites the file when its content changed.
+func (p *RouteFile) Reload() error {
+	if p.s == nil {
+		return nil
+	}
+	var lines []string
+	for _, h := range p.s.Hosts {
+		if h.UUID == p.s.SelfHost.UUID {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(h.Labels[setting.SubnetLabel])
+		agentIP := routeupdate.AgentIP(h)
+		if err != nil || net.ParseIP(agentIP) == nil {
+			logrus.Warnf("routefile: skipping host %s without a valid subnet or agent IP", h.UUID)
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("%s via %s\n", subnet, agentIP))
+	}
+	sort.Strings(lines)
+	var buf bytes.Buffer
+	for _, l := range lines {
+		buf.WriteString(l)
+	}
+
+	current, err := ioutil.ReadFile(p.path)
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Failed to read %s", p.path)
+	}
+	if err == nil && bytes.Equal(current, buf.Bytes()) {
+		return nil
+	}
+	logrus.Infof("routefile: writing %d routes to %s", len(lines), p.path)
+	return state.WriteFileAtomic(p.path, buf.Bytes())
+}
@@ -1,26 +1,100 @@
 package routeupdate
 
 import (
+	"sort"
+	"sync"
+
 	"github.com/pkg/errors"
 	"github.com/rancher/go-rancher-metadata/metadata"
-	"github.com/rancher/per-host-subnet/routeupdate/hostgw"
+	"github.com/rancher/per-host-subnet/reconcile"
+	"github.com/rancher/per-host-subnet/setting"
 )
 
 type RouteUpdate interface {
-	Start()
+	reconcile.Subsystem
 	Reload() error
 }
 
-func Run(provider string, m metadata.Client) (RouteUpdate, error) {
-	switch provider {
-	case hostgw.ProviderName:
-		r, err := hostgw.New(m)
-		if err != nil {
-			return nil, err
+// Options are the provider specific settings, as key=value pairs.
+type Options map[string]string
+
+// Factory creates a provider. The reconciler feeds it metadata snapshots and
+// hands out its retry queue, delete guard and state.
+type Factory func(opts Options, r *reconcile.Reconciler) (RouteUpdate, error)
+
+type Provider struct {
+	Name        string
+	Description string
+	Factory     Factory
+}
+
+var (
+	providersLock sync.Mutex
+	providers     = map[string]Provider{}
+)
+
+// Register makes a provider available by name, it is meant to be called from
+// the init function of the provider package.
+func Register(name, description string, factory Factory) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	if _, ok := providers[name]; ok {
+		panic("routeupdate: provider " + name + " registered twice")
+	}
+	providers[name] = Provider{
+		Name:        name,
+		Description: description,
+		Factory:     factory,
+	}
+}
+
+func Lookup(name string) (Provider, bool) {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	p, ok := providers[name]
+	return p, ok
+}
+
+// Providers returns the registered providers sorted by name.
+func Providers() []Provider {
+	providersLock.Lock()
+	defer providersLock.Unlock()
+	var rtn []Provider
+	for _, p := range providers {
+		rtn = append(rtn, p)
+	}
+	sort.Slice(rtn, func(i, j int) bool {
+		return rtn[i].Name < rtn[j].Name
+	})
+	return rtn
+}
+
+// Validate checks that provider is registered.
+func Validate(provider string) error {
+	if _, ok := Lookup(provider); !ok {
+		var names []string
+		for _, p := range Providers() {
+			names = append(names, p.Name)
 		}
-		r.Start()
-		return r, nil
-	default:
-		return nil, errors.New("No provider specified")
+		return errors.Errorf("Unknown route update provider %q, available: %v", provider, names)
+	}
+	return nil
+}
+
+// AgentIP returns the address the peers route host's subnet to, its agent IP
+// unless overridden by its label.
+func AgentIP(host metadata.Host) string {
+	if v, ok := host.Labels[setting.AgentIPLabel]; ok {
+		return v
+	}
+	return host.AgentIP
+}
+
+// Run creates a single provider routing every peer.
+func Run(provider string, opts Options, r *reconcile.Reconciler) (RouteUpdate, error) {
+	u, err := RunChain([]Rule{{Provider: provider, Options: opts}}, r)
+	if err != nil {
+		return nil, err
 	}
+	return u[0], nil
 }
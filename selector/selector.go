@@ -0,0 +1,98 @@
+// Package selector matches host labels against selectors such as
+// "zone=a,rack!=r1,gpu,!edge".
+package selector
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type op int
+
+const (
+	opEquals op = iota
+	opNotEquals
+	opExists
+	opNotExists
+)
+
+type requirement struct {
+	key   string
+	op    op
+	value string
+}
+
+// Selector is a list of requirements that must all hold, the empty Selector
+// matches everything.
+type Selector struct {
+	requirements []requirement
+	text         string
+}
+
+// Parse parses comma separated requirements, each one of key=value,
+// key!=value, key or !key.
+func Parse(s string) (Selector, error) {
+	sel := Selector{text: strings.TrimSpace(s)}
+	if sel.text == "" {
+		return sel, nil
+	}
+	for _, term := range strings.Split(sel.text, ",") {
+		term = strings.TrimSpace(term)
+		var req requirement
+		switch {
+		case term == "":
+			return sel, errors.Errorf("Invalid selector %q: empty requirement", s)
+		case strings.Contains(term, "!="):
+			parts := strings.SplitN(term, "!=", 2)
+			req = requirement{key: parts[0], op: opNotEquals, value: parts[1]}
+		case strings.Contains(term, "="):
+			parts := strings.SplitN(strings.Replace(term, "==", "=", 1), "=", 2)
+			req = requirement{key: parts[0], op: opEquals, value: parts[1]}
+		case strings.HasPrefix(term, "!"):
+			req = requirement{key: term[1:], op: opNotExists}
+		default:
+			req = requirement{key: term, op: opExists}
+		}
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		if req.key == "" {
+			return sel, errors.Errorf("Invalid selector %q: missing label in %q", s, term)
+		}
+		sel.requirements = append(sel.requirements, req)
+	}
+	return sel, nil
+}
+
+func (s Selector) Empty() bool {
+	return len(s.requirements) == 0
+}
+
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, req := range s.requirements {
+		v, ok := labels[req.key]
+		switch req.op {
+		case opEquals:
+			if !ok || v != req.value {
+				return false
+			}
+		case opNotEquals:
+			if ok && v == req.value {
+				return false
+			}
+		case opExists:
+			if !ok {
+				return false
+			}
+		case opNotExists:
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s Selector) String() string {
+	return s.text
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+	"github.com/rancher/per-host-subnet/failover"
+	"github.com/rancher/per-host-subnet/reconcile"
+)
+
+type server struct {
+	r *reconcile.Reconciler
+	m *failover.Client
+}
+
+type statusResponse struct {
+	reconcile.Status
+	MetadataEndpoints []failover.EndpointStatus `json:"metadataEndpoints"`
+}
+
+// ListenAndServe exposes the reconciler status over HTTP on address, as JSON
+// on /status and in the Prometheus text format on /metrics.
+func ListenAndServe(address string, r *reconcile.Reconciler, m *failover.Client) error {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to listen on %s", address)
+	}
+	s := &server{
+		r: r,
+		m: m,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", s.status)
+	mux.HandleFunc("/metrics", s.metrics)
+	go func() {
+		if err := http.Serve(l, mux); err != nil {
+			logrus.Errorf("Status server stopped: %v", err)
+		}
+	}()
+	logrus.Infof("Serving status on %s", address)
+	return nil
+}
+
+func (s *server) status(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, statusResponse{
+		Status:            s.r.Status(),
+		MetadataEndpoints: s.m.Endpoints(),
+	})
+}
+
+func (s *server) metrics(w http.ResponseWriter, req *http.Request) {
+	status := s.r.Status()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# TYPE per_host_subnet_reconciles_total counter")
+	for _, ss := range status.Subsystems {
+		fmt.Fprintf(w, "per_host_subnet_reconciles_total{subsystem=%q} %d\n", ss.Name, ss.Reconciles)
+	}
+	fmt.Fprintln(w, "# TYPE per_host_subnet_reconcile_failures_total counter")
+	for _, ss := range status.Subsystems {
+		fmt.Fprintf(w, "per_host_subnet_reconcile_failures_total{subsystem=%q} %d\n", ss.Name, ss.Failures)
+	}
+	fmt.Fprintln(w, "# TYPE per_host_subnet_item_failures_total counter")
+	for _, ss := range status.Subsystems {
+		var ops []string
+		for op := range ss.ItemFailures {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		for _, op := range ops {
+			fmt.Fprintf(w, "per_host_subnet_item_failures_total{subsystem=%q,op=%q} %d\n", ss.Name, op, ss.ItemFailures[op])
+		}
+	}
+	fmt.Fprintln(w, "# TYPE per_host_subnet_failed_items gauge")
+	for _, ss := range status.Subsystems {
+		fmt.Fprintf(w, "per_host_subnet_failed_items{subsystem=%q} %d\n", ss.Name, len(ss.Errors))
+	}
+	fmt.Fprintln(w, "# TYPE per_host_subnet_retry_items gauge")
+	for _, ss := range status.Subsystems {
+		fmt.Fprintf(w, "per_host_subnet_retry_items{subsystem=%q} %d\n", ss.Name, len(ss.Retries))
+	}
+	fmt.Fprintln(w, "# TYPE per_host_subnet_metadata_endpoint_up gauge")
+	for _, e := range s.m.Endpoints() {
+		fmt.Fprintf(w, "per_host_subnet_metadata_endpoint_up{url=%q} %d\n", e.URL, boolToInt(e.Healthy))
+	}
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		logrus.Errorf("Failed to write response: %v", err)
+	}
+}
@@ -1,14 +1,60 @@
 package setting
 
-import "github.com/rancher/per-host-subnet/routeupdate/hostgw"
+import (
+	"time"
+)
 
 const (
-	MetadataURL            = "http://%s/2016-07-29"
-	DefaultMetadataAddress = "169.254.169.250"
+	MetadataURL               = "http://%s/%s"
+	DefaultMetadataAddress    = "169.254.169.250"
+	DefaultMetadataAPIVersion = "2016-07-29"
+
+	DefaultPollInterval   = 5 * time.Second
+	DefaultPollJitter     = 0.2
+	DefaultResyncInterval = 5 * time.Minute
+
+	DefaultRetryInitialBackoff = 5 * time.Second
+	DefaultRetryMaxBackoff     = 5 * time.Minute
+
+	DefaultMaxDeleteFraction     = 0.5
+	DefaultDeleteConfirmVersions = 3
+
+	DefaultStatusAddress = "127.0.0.1:8112"
+
+	MetadataCacheFile = "metadata-cache.json"
+	StateFile         = "state.json"
 )
 
 const (
-	DefaultRouteUpdateProvider = hostgw.ProviderName
+	NATBackendIPTables = "iptables"
+	NATBackendNFTables = "nftables"
+)
+
+const (
+	DefaultRouteUpdateProvider = "hostgw"
+	DefaultNATBackend          = NATBackendIPTables
+
+	DefaultDisableHostNATIPset  = "RANCHER_DISABLE_HOST_NAT_IPSET"
+	DefaultNoMasqueradeIPSet    = "RANCHER_NO_MASQUERADE_IPSET"
+	DefaultForceMasqueradeIPSet = "RANCHER_FORCE_MASQUERADE_IPSET"
+	DefaultEgressIPSet          = "RANCHER_EGRESS_IPSET"
+	DefaultNATChain             = "RANCHER_PER_HOST_SUBNET_NAT"
+	DefaultNATTable             = "rancher_per_host_subnet"
+	DefaultHostPortsNetwork     = "transparent"
+
+	DefaultSubnetLabel   = "io.rancher.network.per_host_subnet.subnet"
+	DefaultRouterIPLabel = "io.rancher.network.per_host_subnet.router_ip"
+	DefaultAgentIPLabel  = "io.rancher.network.per_host_subnet.override_agent_ip"
+	DefaultDrainLabel    = "io.rancher.network.per_host_subnet.drain"
+
+	DefaultNATExemptKey = "io.rancher.network.per_host_subnet.nat_exempt"
+
+	DefaultNoMasqueradeLabel    = "io.rancher.network.per_host_subnet.no_masquerade"
+	DefaultForceMasqueradeLabel = "io.rancher.network.per_host_subnet.force_masquerade"
+	DefaultSNATAddressLabel     = "io.rancher.network.per_host_subnet.snat_address"
 
-	DefaultDisableHostNATIPset = "RANCHER_DISABLE_HOST_NAT_IPSET"
+	DefaultEgressLabel        = "io.rancher.network.per_host_subnet.egress"
+	DefaultEgressGatewayLabel = "io.rancher.network.per_host_subnet.egress_gateway"
+	DefaultEgressTable        = 200
+	DefaultEgressRulePriority = 1000
 )
@@ -0,0 +1,29 @@
+package setting
+
+// Label keys and object names, the config file can change them. They're set
+// before the reconciler starts and on reload, from the reconciler goroutine,
+// which is also the only one reading them.
+var (
+	SubnetLabel   = DefaultSubnetLabel
+	RouterIPLabel = DefaultRouterIPLabel
+	AgentIPLabel  = DefaultAgentIPLabel
+	NATExemptKey  = DefaultNATExemptKey
+
+	NoMasqueradeLabel    = DefaultNoMasqueradeLabel
+	ForceMasqueradeLabel = DefaultForceMasqueradeLabel
+	SNATAddressLabel     = DefaultSNATAddressLabel
+	EgressLabel          = DefaultEgressLabel
+	EgressGatewayLabel   = DefaultEgressGatewayLabel
+
+	NATIPSet             = DefaultDisableHostNATIPset
+	NoMasqueradeIPSet    = DefaultNoMasqueradeIPSet
+	ForceMasqueradeIPSet = DefaultForceMasqueradeIPSet
+	EgressIPSet          = DefaultEgressIPSet
+	NATChain             = DefaultNATChain
+	NATTable             = DefaultNATTable
+	HostPortsNetwork     = DefaultHostPortsNetwork
+)
+
+// NATExemptCIDRs are exempted from host NAT along with the peer subnets, they
+// change like the names above.
+var NATExemptCIDRs []string
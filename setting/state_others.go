@@ -0,0 +1,7 @@
+//+build !windows
+
+package setting
+
+const (
+	DefaultStateDir = "/var/lib/rancher/per-host-subnet"
+)
@@ -0,0 +1,7 @@
+//+build windows
+
+package setting
+
+const (
+	DefaultStateDir = "C:/ProgramData/rancher/per-host-subnet"
+)
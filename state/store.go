@@ -0,0 +1,190 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Store records every object the agent created, by owner and kind, in a
+// local file. A later run uses it to clean up exactly what the previous one
+// left behind instead of guessing from the kernel state. Changes are kept in
+// memory until Save, the reconciler saves once per pass.
+type Store struct {
+	sync.Mutex
+	path   string
+	owners map[string]map[string]map[string]json.RawMessage
+	dirty  bool
+}
+
+// Open loads the store at path, a missing file is an empty store and an
+// empty path keeps it in memory only.
+func Open(path string) (*Store, error) {
+	s := &Store{
+		path:   path,
+		owners: map[string]map[string]map[string]json.RawMessage{},
+	}
+	if path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, errors.Wrap(err, "Failed to read state file")
+	}
+	if err := json.Unmarshal(data, &s.owners); err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse state file %s", path)
+	}
+	return s, nil
+}
+
+func (s *Store) Owner(name string) *Owner {
+	return &Owner{
+		s:    s,
+		name: name,
+	}
+}
+
+// Save writes the store to its file if it changed since the last Save.
+func (s *Store) Save() error {
+	s.Lock()
+	defer s.Unlock()
+	if !s.dirty || s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s.owners, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to marshal state")
+	}
+	if err := WriteFileAtomic(s.path, data); err != nil {
+		return err
+	}
+	s.dirty = false
+	return nil
+}
+
+// Owner is the part of the store belonging to one subsystem.
+type Owner struct {
+	s    *Store
+	name string
+}
+
+// Known reports whether this owner ever recorded anything, a false value
+// means the objects found in the kernel may predate the store.
+func (o *Owner) Known() bool {
+	o.s.Lock()
+	defer o.s.Unlock()
+	_, ok := o.s.owners[o.name]
+	return ok
+}
+
+// Init marks the owner as known even if it has nothing to record yet.
+func (o *Owner) Init() error {
+	o.s.Lock()
+	defer o.s.Unlock()
+	if _, ok := o.s.owners[o.name]; ok {
+		return nil
+	}
+	o.s.owners[o.name] = map[string]map[string]json.RawMessage{}
+	o.s.dirty = true
+	return nil
+}
+
+// Add records obj as created under kind and key.
+func (o *Owner) Add(kind, key string, obj interface{}) error {
+	data, err := json.Marshal(obj)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to marshal %s %s", kind, key)
+	}
+	o.s.Lock()
+	defer o.s.Unlock()
+	kinds, ok := o.s.owners[o.name]
+	if !ok {
+		kinds = map[string]map[string]json.RawMessage{}
+		o.s.owners[o.name] = kinds
+	}
+	if kinds[kind] == nil {
+		kinds[kind] = map[string]json.RawMessage{}
+	}
+	kinds[kind][key] = data
+	o.s.dirty = true
+	return nil
+}
+
+// Remove forgets the object of kind under key.
+func (o *Owner) Remove(kind, key string) error {
+	o.s.Lock()
+	defer o.s.Unlock()
+	if _, ok := o.s.owners[o.name][kind][key]; !ok {
+		return nil
+	}
+	delete(o.s.owners[o.name][kind], key)
+	o.s.dirty = true
+	return nil
+}
+
+// Has reports whether an object of kind is recorded under key.
+func (o *Owner) Has(kind, key string) bool {
+	o.s.Lock()
+	defer o.s.Unlock()
+	_, ok := o.s.owners[o.name][kind][key]
+	return ok
+}
+
+// Keys returns the sorted keys recorded under kind.
+func (o *Owner) Keys(kind string) []string {
+	o.s.Lock()
+	defer o.s.Unlock()
+	var keys []string
+	for key := range o.s.owners[o.name][kind] {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Get decodes the object of kind recorded under key into obj.
+func (o *Owner) Get(kind, key string, obj interface{}) error {
+	o.s.Lock()
+	defer o.s.Unlock()
+	data, ok := o.s.owners[o.name][kind][key]
+	if !ok {
+		return errors.Errorf("No %s %s recorded", kind, key)
+	}
+	return json.Unmarshal(data, obj)
+}
+
+// WriteFileAtomic never leaves a truncated file behind, even if the agent
+// dies halfway through or the host loses power: the data is synced before
+// the rename and the directory after it.
+func WriteFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "Failed to create directory for %s", path)
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to create %s", tmp)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "Failed to write %s", tmp)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrapf(err, "Failed to rename %s", tmp)
+	}
+	return syncDir(dir)
+}
@@ -0,0 +1,19 @@
+//+build !windows
+
+package state
+
+import (
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to open %s", dir)
+	}
+	defer d.Close()
+	return errors.Wrapf(d.Sync(), "Failed to sync %s", dir)
+}
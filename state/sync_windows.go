@@ -0,0 +1,9 @@
+//+build windows
+
+package state
+
+// syncDir does nothing, windows can't sync a directory and NTFS journals
+// the rename itself.
+func syncDir(dir string) error {
+	return nil
+}